@@ -0,0 +1,335 @@
+// 本地 HTTP 接口
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"encoding/json"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API 书库的 HTTP 接口，和微信共用下载队列
+type API struct {
+	lib *Library
+	mux *http.ServeMux
+}
+
+// BookInfo 书籍列表中的一项
+type BookInfo struct {
+	Source      string    `json:"source"`
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Author      string    `json:"author"`
+	Category    string    `json:"category"`
+	Url         string    `json:"url"`
+	LastChapter string    `json:"last_chapter"`
+	LastUpdate  string    `json:"last_update"`
+	CheckedAt   time.Time `json:"checked_at"`
+	Chapters    int       `json:"chapters"`
+	Downloaded  bool      `json:"downloaded"`
+}
+
+// BookDetail 书籍目录
+type BookDetail struct {
+	BookInfo
+	ChapterList []Chapter `json:"chapter_list"`
+	Missing     []Chapter `json:"missing"`
+	Job         *JobInfo  `json:"job,omitempty"`
+}
+
+// JobInfo 下载任务状态
+type JobInfo struct {
+	Source   string `json:"source"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Percent  int    `json:"percent"`
+	Position int    `json:"position"`
+	Error    string `json:"error,omitempty"`
+	New      int    `json:"new"`     // 本次新增章节数
+	Missing  int    `json:"missing"` // 本次仍未下载的章节数
+}
+
+// NewAPI 创建 HTTP 接口
+func NewAPI(lib *Library) *API {
+	api := &API{lib: lib, mux: http.NewServeMux()}
+
+	api.mux.HandleFunc("/api/books", api.books)
+	api.mux.HandleFunc("/api/books/", api.book)
+	api.mux.HandleFunc("/api/jobs", api.jobs)
+	api.mux.HandleFunc("/api/fetch", api.fetchStats)
+	api.mux.HandleFunc("/opds", api.opds)
+	api.mux.HandleFunc("/opds/", api.opds)
+
+	return api
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+// books GET /api/books?q=&offset=&limit=
+func (api *API) books(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	var cls []Catalog
+	total := 0
+	if query := strings.TrimSpace(q.Get("q")); query != "" {
+		cls, total = api.lib.SearchPage(query, offset, limit)
+	} else {
+		var err error
+		if cls, err = api.lib.db.Page(offset, limit); err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		total = api.lib.db.Count()
+	}
+
+	books := make([]BookInfo, 0, len(cls))
+	for _, cl := range cls {
+		books = append(books, api.bookInfo(cl))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total": total,
+		"books": books,
+	})
+}
+
+// book /api/books/{source}/{id}[/download|/job|/file]
+func (api *API) book(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/books/"), "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		httpError(w, http.StatusNotFound, "invalid book id")
+		return
+	}
+
+	cl, err := api.lib.db.Get(parts[0], id)
+	if err != nil {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+
+	method := http.MethodGet
+	if action == "download" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch action {
+	case "":
+		api.detail(w, cl)
+	case "download":
+		api.download(w, r, cl)
+	case "job":
+		api.job(w, cl)
+	case "file":
+		api.file(w, r, cl)
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (api *API) detail(w http.ResponseWriter, cl Catalog) {
+	d := BookDetail{
+		BookInfo:    api.bookInfo(cl),
+		ChapterList: cl.Chapters,
+		Missing:     api.lib.MissingChapters(cl),
+	}
+
+	if j, ok := api.lib.jobs.Find(cl); ok {
+		d.Job = api.jobInfo(j)
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// download 开始下载或检查更新，已是最新时直接返回 200
+func (api *API) download(w http.ResponseWriter, r *http.Request, cl Catalog) {
+	refresh, _ := strconv.ParseBool(r.URL.Query().Get("refresh"))
+
+	job, _ := api.lib.FetchBook(cl, refresh, nil)
+	if job == nil {
+		writeJSON(w, http.StatusOK, api.bookInfo(cl))
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, api.jobInfo(job))
+}
+
+func (api *API) job(w http.ResponseWriter, cl Catalog) {
+	j, ok := api.lib.jobs.Find(cl)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no download job for "+cl.Name)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, api.jobInfo(j))
+}
+
+// file GET /api/books/{source}/{id}/file?format=txt|epub|md&lang=zh-Hant
+func (api *API) file(w http.ResponseWriter, r *http.Request, cl Catalog) {
+	q := r.URL.Query()
+
+	format := q.Get("format")
+	if format == "" {
+		format = "txt"
+	}
+	if format != "txt" && format != "epub" && format != "md" {
+		httpError(w, http.StatusBadRequest, "unknown format "+format)
+		return
+	}
+
+	conv, err := ConverterByLang(q.Get("lang"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	bookpath, err := api.lib.ExportBook(cl, format, conv)
+	if os.IsNotExist(err) {
+		httpError(w, http.StatusNotFound, cl.Name+" not downloaded")
+		return
+	} else if err != nil {
+		logrus.Errorf("生成【%s】失败: %v", cl.Name, err)
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	f, err := os.Open(bookpath)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	name := conv.Convert(cl.Name) + filepath.Ext(bookpath)
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+neturl.PathEscape(name))
+	switch format {
+	case "epub":
+		w.Header().Set("Content-Type", "application/epub+zip")
+	case "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// jobs GET /api/jobs
+func (api *API) jobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	jobs := []*JobInfo{}
+	for _, j := range api.lib.jobs.List() {
+		jobs = append(jobs, api.jobInfo(j))
+	}
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// fetchStats GET /api/fetch
+func (api *API) fetchStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"hosts":   api.lib.fetch.Stats(),
+		"proxies": api.lib.fetch.Proxies(),
+	})
+}
+
+func (api *API) bookInfo(cl Catalog) BookInfo {
+	return BookInfo{
+		Source:      cl.Source,
+		ID:          cl.ID,
+		Name:        cl.Name,
+		Author:      cl.Author,
+		Category:    cl.Category,
+		Url:         cl.Url,
+		LastChapter: cl.LastChapter,
+		LastUpdate:  cl.LastUpdate,
+		CheckedAt:   cl.CheckedAt,
+		Chapters:    len(cl.Chapters),
+		Downloaded:  api.lib.Downloaded(cl),
+	}
+}
+
+func (api *API) jobInfo(j *Job) *JobInfo {
+	s := api.lib.jobs.Status(j)
+
+	api.lib.jobs.Lock()
+	cl := j.Catalog
+	up := j.Update
+	api.lib.jobs.Unlock()
+
+	return &JobInfo{
+		Source:   cl.Source,
+		ID:       cl.ID,
+		Name:     s.Name,
+		State:    s.State,
+		Percent:  s.Percent,
+		Position: s.Position,
+		Error:    s.Err,
+		New:      len(up.New),
+		Missing:  len(up.Missing),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,139 @@
+// 笔趣阁 www.bqg5200.com
+package main
+
+import (
+	"github.com/PuerkitoBio/goquery"
+
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	bqg5200BookReg    = regexp.MustCompile(`https:\/\/www.bqg5200.com\/xiaoshuo\/(\d+)\/(\d+)[\/]?$`)
+	bqg5200ChapterReg = regexp.MustCompile(`https:\/\/www.bqg5200.com\/xiaoshuo\/\d+\/\d+\/(\d+).html`)
+)
+
+type bqg5200 struct{}
+
+func init() {
+	RegisterSource(bqg5200{})
+}
+
+func (bqg5200) Name() string {
+	return "bqg5200"
+}
+
+func (bqg5200) Domains() []string {
+	return []string{"www.bqg5200.com"}
+}
+
+func (bqg5200) Match(url string) bool {
+	return strings.HasPrefix(url, `https://www.bqg5200.com`)
+}
+
+func (bqg5200) BookURL(id int) string {
+	sid := strconv.Itoa(id)
+	subid := "0"
+
+	if len(sid) > 3 {
+		subid = strings.TrimSuffix(sid, sid[len(sid)-3:])
+	}
+
+	return fmt.Sprintf("https://www.bqg5200.com/xiaoshuo/%s/%s/", subid, sid)
+}
+
+// IDs 全站书籍 ID，从 33630 倒序抓取（最大 57260）
+func (bqg5200) IDs() []int {
+	ids := make([]int, 0, 33630)
+	for i := 33630; i >= 1; i-- {
+		ids = append(ids, i)
+	}
+	return ids
+}
+
+func (bqg5200) Encoding() string {
+	return "gbk"
+}
+
+func (bqg5200) CatalogSelector() string {
+	return "div#maininfo"
+}
+
+func (bqg5200) ParseCatalog(url string, dom *goquery.Selection) (Catalog, error) {
+	cl := Catalog{}
+
+	idr := bqg5200BookReg.FindStringSubmatch(url)
+	if idr == nil {
+		return cl, fmt.Errorf("not a bqg5200 book url [%s]", url)
+	}
+
+	id, _ := strconv.Atoi(idr[2])
+
+	title := dom.Find("div.coverecom div:nth-of-type(2)")
+
+	cpts := []Chapter{}
+	dom.Find("#readerlist ul li").Each(func(i int, s *goquery.Selection) {
+
+		curl, _ := s.Find("a").Attr("href")
+		curl = absoluteURL(url, curl)
+
+		if bqg5200ChapterReg.MatchString(curl) {
+			cid, err := strconv.Atoi(bqg5200ChapterReg.FindStringSubmatch(curl)[1])
+
+			if err != nil {
+				cid = 0
+			}
+
+			cpts = append(cpts, Chapter{
+				ID:   cid,
+				Name: cleanText(s.Find("a").Text()),
+				Url:  curl,
+			})
+		}
+	})
+
+	cl.ID = id
+	cl.SubID = idr[1]
+	cl.Source = "bqg5200"
+	cl.Name = cleanText(title.Find("h1").Text())
+	cl.Author = title.Find("span:first-of-type").Text()
+	cl.Url = url
+	cl.Category = title.Find("span:nth-of-type(2) a").Text()
+	cl.Chapters = cpts
+	cl.LastChapter = dom.Find("#readerlist ul li:last-of-type a").Text()
+	cl.LastUpdate = title.Find("span:nth-of-type(3)").Text()
+
+	return cl, nil
+}
+
+func (bqg5200) ChapterSelector() string {
+	return "body.clo_bg"
+}
+
+func (bqg5200) ParseChapter(url string, dom *goquery.Selection) (Content, error) {
+	ct := Content{}
+
+	cid := bqg5200ChapterReg.FindStringSubmatch(url)
+	if cid == nil {
+		return ct, fmt.Errorf("not a bqg5200 chapter url [%s]", url)
+	}
+
+	id, _ := strconv.Atoi(cid[1])
+
+	//class_name := dom.Find("#header .readNav :nth-child(2)").Text()
+
+	title := strings.TrimSpace(dom.Find("div.title h1").Text())
+
+	dom.Find("div#content div").Remove()
+	article, _ := dom.Find("div#content").Html()
+	article = strings.Replace(article, "聽", " ", -1)
+	article = strings.Replace(article, "<br/>", "\n", -1)
+
+	ct.Book = dom.Find("#header .readNav :nth-child(3)").Text()
+	ct.Chapter = Chapter{ID: id, Url: url, Name: title}
+	ct.Text = article
+
+	return ct, nil
+}
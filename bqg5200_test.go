@@ -0,0 +1,159 @@
+// 笔趣阁解析测试
+package main
+
+import (
+	"github.com/PuerkitoBio/goquery"
+
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const fixtureBookURL = "https://www.bqg5200.com/xiaoshuo/0/7/"
+
+// loadFixture 读取 testdata/bqg5200 下的 GBK 页面
+func loadFixture(t *testing.T, name string) *goquery.Document {
+	t.Helper()
+
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "bqg5200", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err = ToUTF8(body, DetectCharset(body, "", "gbk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return doc
+}
+
+// fixtureSources 内置书源和规则书源解析同一批页面
+func fixtureSources(t *testing.T) []BookSource {
+	t.Helper()
+
+	rule, err := LoadRule(filepath.Join("rules", "bqg5200-rule.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []BookSource{bqg5200{}, rule}
+}
+
+func TestParseCatalog(t *testing.T) {
+	for _, src := range fixtureSources(t) {
+		t.Run(src.Name(), func(t *testing.T) {
+			doc := loadFixture(t, "catalog.html")
+
+			cl, err := src.ParseCatalog(fixtureBookURL, doc.Find(src.CatalogSelector()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct {
+				field, got, want string
+			}{
+				{"Source", cl.Source, src.Name()},
+				{"Name", cl.Name, "测试之书"},
+				{"Author", cl.Author, "作者：某某"},
+				{"Category", cl.Category, "玄幻小说"},
+				{"LastChapter", cl.LastChapter, "第三章 下山"},
+				{"LastUpdate", cl.LastUpdate, "更新时间：2019-05-01 12:00"},
+				{"Url", cl.Url, fixtureBookURL},
+			} {
+				if c.got != c.want {
+					t.Errorf("%s = %q, want %q", c.field, c.got, c.want)
+				}
+			}
+
+			if cl.ID != 7 {
+				t.Errorf("ID = %d, want 7", cl.ID)
+			}
+
+			want := []Chapter{
+				{ID: 8, Url: fixtureBookURL + "8.html", Name: "第一章 山门"},
+				{ID: 9, Url: fixtureBookURL + "9.html", Name: "第二章 入门"},
+				{ID: 10, Url: fixtureBookURL + "10.html", Name: "第三章 下山"},
+			}
+			if !reflect.DeepEqual(cl.Chapters, want) {
+				t.Errorf("Chapters = %+v, want %+v", cl.Chapters, want)
+			}
+		})
+	}
+}
+
+func TestParseCatalogWrongURL(t *testing.T) {
+	for _, src := range fixtureSources(t) {
+		doc := loadFixture(t, "catalog.html")
+
+		if _, err := src.ParseCatalog("https://www.bqg5200.com/top/", doc.Find(src.CatalogSelector())); err == nil {
+			t.Errorf("%s: expected error for a non-book url", src.Name())
+		}
+	}
+}
+
+func TestParseChapter(t *testing.T) {
+	content, err := NewContentPipeline(DefaultConfig().Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file  string
+		id    int
+		title string
+		first string // 处理后的第一段
+	}{
+		{"chapter_8.html", 8, "第一章 山门", "\u3000\u3000清晨的山门笼罩在薄雾之中"},
+		{"chapter_9.html", 9, "第二章 入门", "\u3000\u3000考核比想象中简单"},
+		{"chapter_10.html", 10, "第三章 下山", "\u3000\u3000三年过去"},
+	}
+
+	for _, src := range fixtureSources(t) {
+		for _, tt := range tests {
+			t.Run(src.Name()+"/"+tt.file, func(t *testing.T) {
+				doc := loadFixture(t, tt.file)
+				url := fixtureBookURL + strings.TrimPrefix(tt.file, "chapter_")
+
+				ct, err := src.ParseChapter(url, doc.Find(src.ChapterSelector()))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if ct.Book != "测试之书" {
+					t.Errorf("Book = %q, want 测试之书", ct.Book)
+				}
+				want := Chapter{ID: tt.id, Url: url, Name: tt.title}
+				if ct.Chapter != want {
+					t.Errorf("Chapter = %+v, want %+v", ct.Chapter, want)
+				}
+
+				ct, err = content.Process(ct)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				paragraphs := strings.Split(ct.Text, "\n")
+				if len(paragraphs) != 2 {
+					t.Fatalf("got %d paragraphs, want 2:\n%s", len(paragraphs), ct.Text)
+				}
+				if !strings.HasPrefix(paragraphs[0], tt.first) {
+					t.Errorf("first paragraph = %q, want prefix %q", paragraphs[0], tt.first)
+				}
+				for _, bad := range []string{"聽", "&nbsp;", "<br", "<div", "天才一秒记住", "bqg5200"} {
+					if strings.Contains(ct.Text, bad) {
+						t.Errorf("text contains %q:\n%s", bad, ct.Text)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// 响应录制和回放
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 录制模式
+const (
+	CassetteCache  = "cache"  // 有未过期的录制时直接使用，否则请求后保存
+	CassetteRecord = "record" // 总是请求并覆盖录制
+	CassetteReplay = "replay" // 只使用录制，不访问网络
+)
+
+// ErrNotRecorded 回放时没有找到录制的响应
+var ErrNotRecorded = errors.New("response not recorded")
+
+// Cassette 把 GET 响应保存到磁盘，用于持久缓存或离线回放。
+// 每个响应保存为 <目录>/<域名>/<哈希>.json 和同名的 .body，正文保持原始编码，可以手工编辑
+type Cassette struct {
+	dir    string
+	mode   string
+	maxAge time.Duration
+}
+
+// cassetteEntry 录制的响应头
+type cassetteEntry struct {
+	Method     string
+	URL        string
+	Status     int
+	Header     http.Header
+	RecordedAt time.Time
+}
+
+// NewCassette 创建录制层，mode 为空时返回 nil
+func NewCassette(conf CassetteConfig) (*Cassette, error) {
+	switch conf.Mode {
+	case "":
+		return nil, nil
+	case CassetteCache, CassetteRecord, CassetteReplay:
+	default:
+		return nil, fmt.Errorf("unknown cassette mode [%s]", conf.Mode)
+	}
+
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("cassette mode %s needs a directory", conf.Mode)
+	}
+
+	return &Cassette{dir: conf.Dir, mode: conf.Mode, maxAge: conf.MaxAge}, nil
+}
+
+// Replaying 是否只回放
+func (c *Cassette) Replaying() bool {
+	return c != nil && c.mode == CassetteReplay
+}
+
+func (c *Cassette) path(req *http.Request) string {
+	sum := sha1.Sum([]byte(req.Method + " " + req.URL.String()))
+	host := strings.Replace(req.URL.Host, ":", "_", -1)
+	return filepath.Join(c.dir, host, hex.EncodeToString(sum[:]))
+}
+
+// roundTrip 按模式读取录制或调用 send 后保存 2xx 响应，只处理 GET 请求
+func (c *Cassette) roundTrip(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		if c.mode == CassetteReplay {
+			return nil, fmt.Errorf("%s %s: %v", req.Method, req.URL, ErrNotRecorded)
+		}
+		return send(req)
+	}
+
+	fname := c.path(req)
+
+	// 缓存模式下 no-cache 请求（如内容校验失败后的重试）重新抓取
+	if c.mode == CassetteReplay || (c.mode == CassetteCache && req.Header.Get("Cache-Control") != "no-cache") {
+		resp, err := c.load(fname, req)
+		if err == nil {
+			return resp, nil
+		}
+		if c.mode == CassetteReplay {
+			return nil, fmt.Errorf("%s: %v", req.URL, err)
+		}
+	}
+
+	resp, err := send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 只录制成功的响应，429、5xx 等临时错误录制后会一直返回错误
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err = c.save(fname, req, resp, body); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (c *Cassette) load(fname string, req *http.Request) (*http.Response, error) {
+	data, err := ioutil.ReadFile(fname + ".json")
+	if os.IsNotExist(err) {
+		return nil, ErrNotRecorded
+	} else if err != nil {
+		return nil, err
+	}
+
+	e := cassetteEntry{}
+	if err = json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+
+	if c.mode == CassetteCache && c.maxAge > 0 && time.Since(e.RecordedAt) > c.maxAge {
+		return nil, ErrNotRecorded
+	}
+
+	body, err := ioutil.ReadFile(fname + ".body")
+	if err != nil {
+		return nil, err
+	}
+
+	cr := cachedResponse{status: e.Status, header: e.Header, body: body}
+	if cr.header == nil {
+		cr.header = http.Header{}
+	}
+
+	return cr.response(req), nil
+}
+
+func (c *Cassette) save(fname string, req *http.Request, resp *http.Response, body []byte) error {
+	e := cassetteEntry{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Status:     resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		RecordedAt: time.Now(),
+	}
+	e.Header.Del("Content-Length")
+	e.Header.Del("Set-Cookie")
+
+	data, err := json.MarshalIndent(&e, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = write(fname+".body", body); err != nil {
+		return err
+	}
+
+	return write(fname+".json", data)
+}
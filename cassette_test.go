@@ -0,0 +1,200 @@
+// 录制回放测试
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// downloadBook 抓取目录和章节后合并，返回合并后的文本
+func downloadBook(t *testing.T, lib *Library, url string) (Catalog, string) {
+	t.Helper()
+
+	cl := lib.GetCatalog(url)
+	if cl.Name == "" {
+		t.Fatalf("no catalog from %s", url)
+	}
+
+	lib.fetchContent(&cl)
+
+	if err := fileMerge(lib.store.BookDir(cl), cl.Name, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(lib.store.BookFile(cl, ".txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cl, string(data)
+}
+
+func cassetteMode(mode, dir string) func(*Config) {
+	return func(conf *Config) {
+		conf.Fetch.Cassette.Mode = mode
+		conf.Fetch.Cassette.Dir = dir
+	}
+}
+
+// newCassetteClient 缓存模式的抓取层，rpm 为每分钟请求数
+func newCassetteClient(t *testing.T, rpm int) *http.Client {
+	t.Helper()
+
+	conf := DefaultConfig().Fetch
+	conf.Cassette = CassetteConfig{Mode: CassetteCache, Dir: t.TempDir()}
+	conf.Policy = PolicyFast
+	conf.Policies = map[string]PolicyConfig{
+		PolicyFast: {RequestsPerMinute: rpm},
+	}
+
+	f, err := NewFetcher(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Transport: f.transport, Timeout: 5 * time.Second}
+}
+
+func TestCassetteSkipsErrors(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		n := hits
+		mu.Unlock()
+
+		if n == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	client := newCassetteClient(t, 0)
+
+	for i, want := range []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusOK} {
+		resp, err := client.Get(srv.URL + "/1.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+
+	// 503 没有录制，第二次请求服务器，第三次使用录制
+	mu.Lock()
+	defer mu.Unlock()
+	if hits != 2 {
+		t.Errorf("server hit %d times, want 2", hits)
+	}
+}
+
+func TestCassetteHitSkipsPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// 每分钟只允许一个请求，录制命中不应等待
+	client := newCassetteClient(t, 1)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/1.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cassette hits waited for the rate limit: %v", d)
+	}
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	cassettes := filepath.Join(dir, "cassettes")
+
+	// 第一次请求返回 500，重试成功后才录制
+	srv := newFixtureServer(t, func(w http.ResponseWriter, r *http.Request, hit int) bool {
+		if r.URL.Path == "/xiaoshuo/0/7/9.html" && hit == 1 {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return true
+		}
+		return false
+	})
+	url := srv.URL + "/xiaoshuo/0/7/"
+
+	rec := newTestLibrary(t, filepath.Join(dir, "record"), cassetteMode(CassetteRecord, cassettes))
+	recorded, want := downloadBook(t, rec, url)
+
+	if n := len(rec.store.Chapters(recorded)); n != 3 {
+		t.Fatalf("recorded %d chapters, want 3", n)
+	}
+
+	// 回放时不访问网络
+	srv.Close()
+
+	play := newTestLibrary(t, filepath.Join(dir, "replay"), cassetteMode(CassetteReplay, cassettes))
+	replayed, got := downloadBook(t, play, url)
+
+	if len(replayed.Chapters) != len(recorded.Chapters) {
+		t.Errorf("replayed %d chapters, want %d", len(replayed.Chapters), len(recorded.Chapters))
+	}
+	if got != want {
+		t.Errorf("replayed book differs from recorded book:\n%s\n---\n%s", got, want)
+	}
+
+	if fs, _ := play.db.Failures(replayed); len(fs) != 0 {
+		t.Errorf("replay failures = %+v", fs)
+	}
+
+	for _, s := range play.fetch.Stats() {
+		if s.Requests != 0 {
+			t.Errorf("%s: %d requests sent during replay", s.Host, s.Requests)
+		}
+	}
+}
+
+func TestCassetteReplayTestdata(t *testing.T) {
+	lib := newTestLibrary(t, t.TempDir(), cassetteMode(CassetteReplay, filepath.Join("testdata", "cassettes")))
+
+	cl, text := downloadBook(t, lib, fixtureBookURL)
+
+	if cl.Source != "bqg5200" || cl.ID != 7 {
+		t.Errorf("catalog = %s/%d, want bqg5200/7", cl.Source, cl.ID)
+	}
+
+	if !strings.HasPrefix(text, "## 测试之书\n") {
+		t.Errorf("title line = %q", strings.SplitN(text, "\n", 2)[0])
+	}
+
+	last := -1
+	for _, title := range []string{"### 第一章 山门", "### 第二章 入门", "### 第三章 下山"} {
+		i := strings.Index(text, title)
+		if i < 0 {
+			t.Errorf("%s not found", title)
+			continue
+		}
+		if i < last {
+			t.Errorf("%s out of order", title)
+		}
+		last = i
+	}
+
+	if strings.Contains(text, "天才一秒记住") {
+		t.Errorf("ad not removed:\n%s", text)
+	}
+}
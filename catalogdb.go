@@ -0,0 +1,363 @@
+// 书籍元数据库
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	bucketCatalogs = []byte("catalogs") // 书源:ID -> Catalog
+	bucketNames    = []byte("names")    // 书名\x00书源:ID -> nil
+	bucketAuthors  = []byte("authors")  // 作者\x00书源:ID -> nil
+	bucketMeta     = []byte("meta")
+)
+
+// ErrNotFound 书籍不存在
+var ErrNotFound = errors.New("catalog not found")
+
+// CatalogDB 基于 bbolt 的书籍元数据库，按书源+ID、书名、作者建立索引
+type CatalogDB struct {
+	db *bolt.DB
+}
+
+// OpenCatalogDB 打开数据库，文件不存在时创建
+func OpenCatalogDB(fname string) (*CatalogDB, error) {
+	if err := ensureDir(fname); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(fname, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketCatalogs, bucketNames, bucketAuthors, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &CatalogDB{db: db}, nil
+}
+
+// Close 关闭数据库
+func (d *CatalogDB) Close() error {
+	return d.db.Close()
+}
+
+func catalogKey(source string, id int) []byte {
+	return []byte(fmt.Sprintf("%s:%d", source, id))
+}
+
+func indexKey(value string, key []byte) []byte {
+	return append([]byte(strings.ToLower(strings.TrimSpace(value))+"\x00"), key...)
+}
+
+// Put 新增或更新书籍，同时更新索引
+func (d *CatalogDB) Put(cl Catalog) error {
+	if cl.Source == "" {
+		return fmt.Errorf("catalog [%s] has no source", cl.Name)
+	}
+
+	key := catalogKey(cl.Source, cl.ID)
+
+	data, err := json.Marshal(&cl)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		cb := tx.Bucket(bucketCatalogs)
+		nb := tx.Bucket(bucketNames)
+		ab := tx.Bucket(bucketAuthors)
+
+		if v := cb.Get(key); v != nil {
+			old := Catalog{}
+			if err := json.Unmarshal(v, &old); err == nil {
+				nb.Delete(indexKey(old.Name, key))
+				ab.Delete(indexKey(old.Author, key))
+			}
+		}
+
+		if err := cb.Put(key, data); err != nil {
+			return err
+		}
+		if err := nb.Put(indexKey(cl.Name, key), nil); err != nil {
+			return err
+		}
+		return ab.Put(indexKey(cl.Author, key), nil)
+	})
+}
+
+// Get 按书源和 ID 读取书籍
+func (d *CatalogDB) Get(source string, id int) (Catalog, error) {
+	cl := Catalog{}
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketCatalogs).Get(catalogKey(source, id))
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, &cl)
+	})
+
+	return cl, err
+}
+
+// Exists 书籍是否存在
+func (d *CatalogDB) Exists(source string, id int) bool {
+	exist := false
+
+	d.db.View(func(tx *bolt.Tx) error {
+		exist = tx.Bucket(bucketCatalogs).Get(catalogKey(source, id)) != nil
+		return nil
+	})
+
+	return exist
+}
+
+// Delete 删除书籍
+func (d *CatalogDB) Delete(source string, id int) error {
+	key := catalogKey(source, id)
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		cb := tx.Bucket(bucketCatalogs)
+
+		v := cb.Get(key)
+		if v == nil {
+			return nil
+		}
+
+		old := Catalog{}
+		if err := json.Unmarshal(v, &old); err == nil {
+			tx.Bucket(bucketNames).Delete(indexKey(old.Name, key))
+			tx.Bucket(bucketAuthors).Delete(indexKey(old.Author, key))
+		}
+
+		return cb.Delete(key)
+	})
+}
+
+// ByName 按书名查找，不同书源或不同作者的同名书都会返回
+func (d *CatalogDB) ByName(name string) ([]Catalog, error) {
+	return d.byIndex(bucketNames, name)
+}
+
+// ByAuthor 按作者查找
+func (d *CatalogDB) ByAuthor(author string) ([]Catalog, error) {
+	return d.byIndex(bucketAuthors, author)
+}
+
+func (d *CatalogDB) byIndex(bucket []byte, value string) ([]Catalog, error) {
+	cls := []Catalog{}
+	prefix := indexKey(value, nil)
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		cb := tx.Bucket(bucketCatalogs)
+		c := tx.Bucket(bucket).Cursor()
+
+		for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+			v := cb.Get(k[len(prefix):])
+			if v == nil {
+				continue
+			}
+
+			cl := Catalog{}
+			if err := json.Unmarshal(v, &cl); err != nil {
+				return err
+			}
+			cls = append(cls, cl)
+		}
+
+		return nil
+	})
+
+	return cls, err
+}
+
+// Each 遍历所有书籍，fn 返回错误时停止
+func (d *CatalogDB) Each(fn func(Catalog) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCatalogs).ForEach(func(k, v []byte) error {
+			cl := Catalog{}
+			if err := json.Unmarshal(v, &cl); err != nil {
+				return err
+			}
+			return fn(cl)
+		})
+	})
+}
+
+// List 所有书籍
+func (d *CatalogDB) List() ([]Catalog, error) {
+	cls := []Catalog{}
+
+	err := d.Each(func(cl Catalog) error {
+		cls = append(cls, cl)
+		return nil
+	})
+
+	return cls, err
+}
+
+// Page 按键的顺序读取一页书籍，跳过的书籍不解码
+func (d *CatalogDB) Page(offset, limit int) ([]Catalog, error) {
+	cls := []Catalog{}
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketCatalogs).Cursor()
+
+		k, v := c.First()
+		for i := 0; k != nil && i < offset; i++ {
+			k, v = c.Next()
+		}
+
+		for ; k != nil && (limit <= 0 || len(cls) < limit); k, v = c.Next() {
+			cl := Catalog{}
+			if err := json.Unmarshal(v, &cl); err != nil {
+				return err
+			}
+			cls = append(cls, cl)
+		}
+
+		return nil
+	})
+
+	return cls, err
+}
+
+// IDs 书源下已有的书籍 ID
+func (d *CatalogDB) IDs(source string) map[int]bool {
+	ids := make(map[int]bool)
+	prefix := []byte(source + ":")
+
+	d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketCatalogs).Cursor()
+
+		for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+			var id int
+			if _, err := fmt.Sscanf(string(k[len(prefix):]), "%d", &id); err == nil {
+				ids[id] = true
+			}
+		}
+
+		return nil
+	})
+
+	return ids
+}
+
+// Count 书籍数量
+func (d *CatalogDB) Count() int {
+	n := 0
+
+	d.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucketCatalogs).Stats().KeyN
+		return nil
+	})
+
+	return n
+}
+
+// Meta 读取元信息
+func (d *CatalogDB) Meta(key string) string {
+	value := ""
+
+	d.db.View(func(tx *bolt.Tx) error {
+		value = string(tx.Bucket(bucketMeta).Get([]byte(key)))
+		return nil
+	})
+
+	return value
+}
+
+// SetMeta 保存元信息
+func (d *CatalogDB) SetMeta(key, value string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put([]byte(key), []byte(value))
+	})
+}
+
+// ImportCatalogs 将书库中旧的 data.json 导入数据库，返回导入数量
+func ImportCatalogs(d *CatalogDB, store *Storage) (int, error) {
+	n := 0
+
+	for _, cl := range store.Catalogs() {
+		if cl.Source == "" {
+			src, err := SourceOf(cl)
+			if err != nil {
+				return n, err
+			}
+			cl.Source = src.Name()
+		}
+
+		if err := d.Put(cl); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// MigrateBookDirs 把旧版按书名建的书籍目录移动到 <书源>/<ID>，返回移动的数量。
+// 目录属于哪本书先看 data.json，没有时按书名查找，同名书无法区分的目录保留原处
+func MigrateBookDirs(d *CatalogDB, store *Storage) (int, error) {
+	n := 0
+
+	for _, dir := range store.legacyDirs() {
+		cl := read(filepath.Join(dir, "data.json"))
+
+		if cl.ID != 0 && cl.Source == "" {
+			src, err := SourceOf(cl)
+			if err != nil {
+				return n, err
+			}
+			cl.Source = src.Name()
+		}
+
+		if cl.ID == 0 {
+			cls, err := d.ByName(filepath.Base(dir))
+			if err != nil {
+				return n, err
+			}
+			if len(cls) != 1 {
+				logrus.Warnf("无法确定 %s 属于哪本书（找到 %d 本同名书），请手动移动到 <书源>/<ID>", dir, len(cls))
+				continue
+			}
+			cl = cls[0]
+		}
+
+		to := store.BookDir(cl)
+		if _, err := os.Stat(to); err == nil {
+			logrus.Warnf("%s 已存在，保留 %s", to, dir)
+			continue
+		}
+
+		if err := ensureDir(to); err != nil {
+			return n, err
+		}
+		if err := os.Rename(dir, to); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
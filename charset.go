@@ -0,0 +1,100 @@
+// 页面编码识别
+package main
+
+import (
+	"github.com/gocolly/colly"
+	"github.com/saintfish/chardet"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/htmlindex"
+
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// <meta charset="gbk"> 或 <meta http-equiv="Content-Type" content="text/html; charset=gbk">
+var metaCharsetReg = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([\w-]+)`)
+
+// DetectCharset 判断页面编码，依次参考 Content-Type、BOM 和 <meta charset>、
+// 字节特征，都无法确定时使用 hint
+func DetectCharset(body []byte, contentType, hint string) string {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if cs := params["charset"]; cs != "" {
+			if _, err := htmlindex.Get(cs); err == nil {
+				return strings.ToLower(cs)
+			}
+		}
+	}
+
+	// BOM
+	if _, name, certain := charset.DetermineEncoding(body, ""); certain {
+		return name
+	}
+
+	head := body
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if m := metaCharsetReg.FindSubmatch(head); m != nil {
+		if _, err := htmlindex.Get(string(m[1])); err == nil {
+			return strings.ToLower(string(m[1]))
+		}
+	}
+
+	if utf8.Valid(body) {
+		return "utf-8"
+	}
+
+	if hint != "" {
+		return hint
+	}
+
+	if r, err := chardet.NewHtmlDetector().DetectBest(body); err == nil {
+		// chardet 的 GB-18030 在 htmlindex 中叫 gb18030
+		cs := strings.ToLower(strings.Replace(r.Charset, "GB-18030", "gb18030", 1))
+		if _, err := htmlindex.Get(cs); err == nil {
+			return cs
+		}
+	}
+
+	return "utf-8"
+}
+
+// ToUTF8 按编码 cs 转换为 UTF-8
+func ToUTF8(body []byte, cs string) ([]byte, error) {
+	enc, err := htmlindex.Get(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return body, nil
+	}
+
+	return ioutil.ReadAll(enc.NewDecoder().Reader(bytes.NewReader(body)))
+}
+
+// normalizeCharset 在解析 HTML 之前把响应转换为 UTF-8，hint 为书源声明的编码
+func normalizeCharset(c *colly.Collector, hint string) {
+	c.OnResponse(func(r *colly.Response) {
+		contentType := r.Headers.Get("Content-Type")
+
+		// Content-Type 中带有编码时 colly 已经转换过
+		if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+			return
+		}
+
+		cs := DetectCharset(r.Body, "", hint)
+
+		body, err := ToUTF8(r.Body, cs)
+		if err != nil {
+			r.Ctx.Put("error", err)
+			return
+		}
+
+		r.Body = body
+	})
+}
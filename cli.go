@@ -0,0 +1,559 @@
+// 命令行
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// 退出码
+const (
+	ExitOK         = 0
+	ExitError      = 1 // 执行失败
+	ExitUsage      = 2 // 参数错误
+	ExitNotFound   = 3 // 没有找到书籍、书名有多个匹配或书籍尚未下载
+	ExitIncomplete = 4 // 执行完成，但仍有章节或 ID 抓取失败
+)
+
+// command 子命令，setup 注册选项并返回执行函数，args 为去掉选项后的参数，
+// 个数在 min 和 max 之间，max 小于 0 时不限制
+type command struct {
+	name     string
+	args     string
+	short    string
+	min, max int
+	setup    func(fs *flag.FlagSet) func(lib *Library, args []string) int
+}
+
+var commands = []command{
+	{"bot", "", "启动微信机器人（默认）", 0, 0, botCommand},
+	{"crawl", "", "抓取全站目录，从上次中断的位置继续", 0, 0, crawlCommand},
+	{"fetch", "<ID|书源:ID|链接>", "抓取一本书的目录并下载章节", 1, 1, fetchCommand},
+	{"update", "[书名]", "更新所有已下载的书或指定的一本", 0, 1, updateCommand},
+	{"merge", "<书名>", "重新合并已下载的章节为 txt", 1, 1, mergeCommand},
+	{"export", "<书名>", "导出 epub、txt 或 md", 1, 1, exportCommand},
+	{"search", "<关键词>", "搜索书籍", 1, -1, searchCommand},
+	{"stats", "", "书库统计", 0, 0, statsCommand},
+}
+
+// runCLI 解析命令行并执行子命令，返回退出码。没有子命令时启动微信机器人
+func runCLI(args []string) int {
+	fs := flag.NewFlagSet("novel", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() { usage(fs) }
+
+	fname := CONFIG_FILE
+	if v := os.Getenv("NOVEL_CONFIG"); v != "" {
+		fname = v
+	}
+	fs.StringVar(&fname, "config", fname, "配置文件，也可以用 NOVEL_CONFIG 指定")
+	debug := fs.Bool("debug", false, "输出调试日志")
+
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return ExitOK
+	} else if err != nil {
+		return ExitUsage
+	}
+
+	if *debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	args = fs.Args()
+	if len(args) == 0 {
+		args = []string{"bot"}
+	}
+
+	if args[0] == "help" {
+		usage(fs)
+		return ExitOK
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "未知命令 %s\n\n", args[0])
+		usage(fs)
+		return ExitUsage
+	}
+
+	cfs := flag.NewFlagSet("novel "+cmd.name, flag.ContinueOnError)
+	cfs.SetOutput(os.Stderr)
+	cfs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "用法: novel %s [选项] %s\n\n%s\n\n", cmd.name, cmd.args, cmd.short)
+		cfs.PrintDefaults()
+	}
+
+	run := cmd.setup(cfs)
+
+	cargs, err := parseArgs(cfs, args[1:])
+	if err == flag.ErrHelp {
+		return ExitOK
+	} else if err != nil {
+		return ExitUsage
+	}
+
+	if len(cargs) < cmd.min || (cmd.max >= 0 && len(cargs) > cmd.max) {
+		cfs.Usage()
+		return ExitUsage
+	}
+
+	conf, err := LoadConfig(fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "读取配置 %s 失败: %v\n", fname, err)
+		return ExitError
+	}
+
+	if err := LoadRules(conf.RulePath); err != nil {
+		fmt.Fprintf(os.Stderr, "加载书源规则失败: %v\n", err)
+		return ExitError
+	}
+
+	lib, err := NewLibrary(conf)
+	if err == bolt.ErrTimeout {
+		fmt.Fprintf(os.Stderr, "打开书库失败: %s 正在被其他进程使用，机器人运行时请通过 HTTP 接口操作\n", conf.DBPath)
+		return ExitError
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "打开书库失败: %v\n", err)
+		return ExitError
+	}
+	defer lib.Close()
+
+	return run(lib, cargs)
+}
+
+func usage(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "用法: novel [-config novel.yml] <命令> [选项] [参数]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "命令:")
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.short)
+	}
+	w.Flush()
+
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "选项:")
+	fs.PrintDefaults()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "novel <命令> -h 查看命令的选项")
+	fmt.Fprintf(os.Stderr, "退出码: %d 成功，%d 失败，%d 参数错误，%d 没有找到书籍，%d 有章节或 ID 抓取失败\n",
+		ExitOK, ExitError, ExitUsage, ExitNotFound, ExitIncomplete)
+}
+
+// parseArgs 解析选项，选项可以放在参数之后，-- 之后的都作为参数
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	rest := []string{}
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		remain := fs.Args()
+		if len(remain) == 0 {
+			return rest, nil
+		}
+
+		if n := len(args) - len(remain); n > 0 && args[n-1] == "--" {
+			return append(rest, remain...), nil
+		}
+
+		rest = append(rest, remain[0])
+		args = remain[1:]
+	}
+}
+
+// cliError 输出错误并返回退出码
+func cliError(code int, format string, a ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	return code
+}
+
+// resolveBook 按 <书源>:<ID> 或书名确定一本书，同名或模糊匹配时列出候选
+func resolveBook(lib *Library, query string) (Catalog, int) {
+	if i := strings.LastIndex(query, ":"); i > 0 {
+		if id, err := strconv.Atoi(query[i+1:]); err == nil {
+			cl, err := lib.db.Get(query[:i], id)
+			if err == ErrNotFound {
+				return cl, cliError(ExitNotFound, "没有找到 %s", query)
+			} else if err != nil {
+				return cl, cliError(ExitError, "读取 %s 失败: %v", query, err)
+			}
+			return cl, ExitOK
+		}
+	}
+
+	cl, cands, err := lib.PickBook("", query)
+	if err != nil {
+		return cl, cliError(ExitError, "查找《%s》失败: %v", query, err)
+	}
+
+	if len(cands) > 0 {
+		fmt.Fprintf(os.Stderr, "找到 %d 本和「%s」相关的书，请用 <书源>:<ID> 指定:\n", len(cands), query)
+		printBooks(lib, os.Stderr, cands)
+		return cl, ExitNotFound
+	}
+
+	if cl.Name == "" {
+		return cl, cliError(ExitNotFound, "没有找到《%s》", query)
+	}
+
+	return cl, ExitOK
+}
+
+// printBooks 每行一本书：<书源>:<ID> 书名 作者 分类 最新章节 是否已下载
+func printBooks(lib *Library, out io.Writer, cls []Catalog) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, cl := range cls {
+		downloaded := ""
+		if lib.Downloaded(cl) {
+			downloaded = "已下载"
+		}
+		fmt.Fprintf(w, "%s:%d\t%s\t%s\t%s\t%s\t%s\n",
+			cl.Source, cl.ID, cl.Name, cl.Author, cl.Category, cl.LastChapter, downloaded)
+	}
+	w.Flush()
+}
+
+// printUpdate 输出一本书的更新结果，有缺失章节时返回 ExitIncomplete
+func printUpdate(up BookUpdate) int {
+	cl := up.Catalog
+
+	fmt.Fprintf(os.Stdout, "《%s》新增 %d 章，缺少 %d 章，最新章节：%s\n", cl.Name, len(up.New), len(up.Missing), cl.LastChapter)
+
+	if len(up.Missing) > 0 {
+		return ExitIncomplete
+	}
+	return ExitOK
+}
+
+// worse 合并多个退出码，失败优先于缺失章节
+func worse(a, b int) int {
+	if a == ExitError || b == ExitError {
+		return ExitError
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func botCommand(fs *flag.FlagSet) func(*Library, []string) int {
+	crawl := fs.Bool("crawl", true, "启动后在后台抓取全站目录")
+
+	return func(lib *Library, args []string) int {
+		if err := runBot(lib, *crawl); err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+		return ExitOK
+	}
+}
+
+func crawlCommand(fs *flag.FlagSet) func(*Library, []string) int {
+	source := fs.String("source", "", "书源名称，默认使用配置中的书源")
+	from := fs.Int("from", 0, "起始 ID，和 -to 都为 0 时使用配置或书源自带的范围")
+	to := fs.Int("to", 0, "结束 ID，可以小于 -from 倒序抓取")
+	retry := fs.Bool("retry", true, "最后重试失败的 ID")
+
+	return func(lib *Library, args []string) int {
+		if *from < 0 || *to < 0 {
+			return cliError(ExitUsage, "ID 范围不正确: %d-%d", *from, *to)
+		}
+
+		if *source != "" {
+			lib.conf.Crawl.Source = *source
+		}
+		if *from != 0 || *to != 0 {
+			lib.conf.Crawl.From, lib.conf.Crawl.To = *from, *to
+		}
+
+		src, err := lib.conf.CrawlSource()
+		if err != nil {
+			return cliError(ExitUsage, "%v", err)
+		}
+
+		job, err := lib.NewCrawlJob(src)
+		if err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+
+		if err = job.Run(); err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+
+		if *retry {
+			if err = job.RetryFailed(); err != nil {
+				return cliError(ExitError, "%v", err)
+			}
+		}
+
+		state := job.Progress()
+		fmt.Fprintln(os.Stdout, state)
+
+		if state.Failed > 0 {
+			return ExitIncomplete
+		}
+		return ExitOK
+	}
+}
+
+func fetchCommand(fs *flag.FlagSet) func(*Library, []string) int {
+	source := fs.String("source", "", "使用的书源，参数为 ID 时默认使用配置中的书源，为链接时默认按链接匹配")
+
+	return func(lib *Library, args []string) int {
+		cl := Catalog{}
+
+		// <书源>:<ID>
+		arg, name := args[0], *source
+		if i := strings.LastIndex(arg, ":"); i > 0 {
+			if _, err := strconv.Atoi(arg[i+1:]); err == nil {
+				arg, name = arg[i+1:], arg[:i]
+			}
+		}
+
+		if id, err := strconv.Atoi(arg); err == nil {
+			if name != "" {
+				lib.conf.Crawl.Source = name
+			}
+
+			src, err := lib.conf.CrawlSource()
+			if err != nil {
+				return cliError(ExitUsage, "%v", err)
+			}
+
+			// 已有记录时按原目录计算新增章节
+			if cl, err = lib.db.Get(src.Name(), id); err != nil {
+				cl = Catalog{Source: src.Name(), ID: id, Url: src.BookURL(id)}
+			}
+		} else {
+			src, err := SourceByURL(args[0])
+			if *source != "" {
+				src, err = SourceByName(*source)
+			}
+			if err != nil {
+				return cliError(ExitUsage, "%v", err)
+			}
+			if !src.Match(args[0]) {
+				return cliError(ExitUsage, "书源 %s 不支持 %s", src.Name(), args[0])
+			}
+
+			if cl = lib.CatalogFrom(src, args[0]); cl.Name == "" {
+				return cliError(ExitError, "没有解析到 %s 的目录", args[0])
+			}
+		}
+
+		up, err := lib.UpdateBook(cl)
+		if err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+
+		return printUpdate(up)
+	}
+}
+
+func updateCommand(fs *flag.FlagSet) func(*Library, []string) int {
+	due := fs.Bool("due", false, "只更新超过更新间隔的书")
+
+	return func(lib *Library, args []string) int {
+		if len(args) == 1 {
+			cl, code := resolveBook(lib, args[0])
+			if code != ExitOK {
+				return code
+			}
+
+			up, err := lib.UpdateBook(cl)
+			if err != nil {
+				return cliError(ExitError, "%v", err)
+			}
+			return printUpdate(up)
+		}
+
+		cls, err := lib.DownloadedBooks()
+		if err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+
+		code := ExitOK
+		for _, cl := range cls {
+			if *due && !lib.NeedsUpdate(cl) {
+				continue
+			}
+
+			up, err := lib.UpdateBook(cl)
+			if err != nil {
+				code = worse(code, cliError(ExitError, "%v", err))
+				continue
+			}
+
+			code = worse(code, printUpdate(up))
+		}
+
+		return code
+	}
+}
+
+func mergeCommand(fs *flag.FlagSet) func(*Library, []string) int {
+	lang := fs.String("lang", "", "zh-Hant 时合并为繁体")
+
+	return func(lib *Library, args []string) int {
+		conv, err := ConverterByLang(*lang)
+		if err != nil {
+			return cliError(ExitUsage, "%v", err)
+		}
+
+		cl, code := resolveBook(lib, args[0])
+		if code != ExitOK {
+			return code
+		}
+
+		if len(lib.store.Chapters(cl)) == 0 {
+			return cliError(ExitNotFound, "《%s》还没有下载章节", cl.Name)
+		}
+
+		if err = fileMerge(lib.store.BookDir(cl), cl.Name, conv); err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+
+		fmt.Fprintln(os.Stdout, lib.store.BookFile(cl, conv.Suffix()+".txt"))
+
+		return ExitOK
+	}
+}
+
+func exportCommand(fs *flag.FlagSet) func(*Library, []string) int {
+	format := fs.String("format", "epub", "导出格式 epub、txt 或 md")
+	lang := fs.String("lang", "", "zh-Hant 时导出繁体")
+	out := fs.String("o", "", "复制到该文件或目录，默认只输出书库中的路径")
+
+	return func(lib *Library, args []string) int {
+		if *format != "epub" && *format != "txt" && *format != "md" {
+			return cliError(ExitUsage, "不支持的格式 %s", *format)
+		}
+
+		conv, err := ConverterByLang(*lang)
+		if err != nil {
+			return cliError(ExitUsage, "%v", err)
+		}
+
+		cl, code := resolveBook(lib, args[0])
+		if code != ExitOK {
+			return code
+		}
+
+		bookpath, err := lib.ExportBook(cl, *format, conv)
+		if os.IsNotExist(err) {
+			return cliError(ExitNotFound, "《%s》还没有下载，先运行 novel fetch %s:%d", cl.Name, cl.Source, cl.ID)
+		} else if err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+
+		if *out != "" {
+			dst := *out
+			if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+				dst = filepath.Join(dst, filepath.Base(bookpath))
+			}
+
+			if err = copyFile(bookpath, dst); err != nil {
+				return cliError(ExitError, "%v", err)
+			}
+			bookpath = dst
+		}
+
+		fmt.Fprintln(os.Stdout, bookpath)
+
+		return ExitOK
+	}
+}
+
+func searchCommand(fs *flag.FlagSet) func(*Library, []string) int {
+	limit := fs.Int("limit", 20, "最多显示的结果数")
+
+	return func(lib *Library, args []string) int {
+		query := strings.Join(args, " ")
+
+		cls := lib.Search(query, *limit)
+		if len(cls) == 0 {
+			return cliError(ExitNotFound, "没有找到和「%s」相关的书", query)
+		}
+
+		printBooks(lib, os.Stdout, cls)
+
+		return ExitOK
+	}
+}
+
+func statsCommand(fs *flag.FlagSet) func(*Library, []string) int {
+	return func(lib *Library, args []string) int {
+		cls, err := lib.DownloadedBooks()
+		if err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+
+		chapters, missing, incomplete := 0, 0, 0
+		for _, cl := range cls {
+			chapters += len(lib.store.Chapters(cl))
+			if n := len(lib.MissingChapters(cl)); n > 0 {
+				missing += n
+				incomplete++
+			}
+		}
+
+		fmt.Fprintf(os.Stdout, "书目: %d 本\n", lib.db.Count())
+		fmt.Fprintf(os.Stdout, "已下载: %d 本，%d 章\n", len(cls), chapters)
+		fmt.Fprintf(os.Stdout, "缺少章节: %d 本，共 %d 章\n", incomplete, missing)
+
+		for _, src := range Sources() {
+			if state, ok := lib.db.CrawlProgress(src.Name()); ok {
+				fmt.Fprintf(os.Stdout, "目录抓取: %s\n", state)
+			}
+		}
+
+		mails, err := lib.mail.Pending()
+		if err != nil {
+			return cliError(ExitError, "%v", err)
+		}
+		fmt.Fprintf(os.Stdout, "待发送邮件: %d 封\n", len(mails))
+
+		return ExitOK
+	}
+}
+
+// copyFile 复制导出的文件
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err = ensureDir(dst); err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,169 @@
+// 章节正文清洗和校验
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrBadContent 正文不合格，章节不会保存，稍后重新下载
+var ErrBadContent = errors.New("bad chapter content")
+
+// ContentFilter 正文处理规则，返回处理后的正文，不合格时返回包装了 ErrBadContent 的错误
+type ContentFilter func(text string) (string, error)
+
+type namedFilter struct {
+	name   string
+	filter ContentFilter
+}
+
+// ContentPipeline 按顺序执行的正文处理规则
+type ContentPipeline struct {
+	filters []namedFilter
+}
+
+// NewContentPipeline 按配置创建默认的处理流程：
+// 去除 HTML 标签、解码实体、删除广告行、检查黑名单、统一缩进、检查长度
+func NewContentPipeline(conf ContentConfig) (*ContentPipeline, error) {
+	p := &ContentPipeline{}
+
+	ads := make([]*regexp.Regexp, 0, len(conf.AdPatterns))
+	for _, pattern := range conf.AdPatterns {
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("content ad pattern %q: %v", pattern, err)
+		}
+		ads = append(ads, reg)
+	}
+
+	p.Use("strip_html", StripHTML)
+	p.Use("decode_entities", DecodeEntities)
+	p.Use("remove_ads", RemoveAdLines(ads))
+	p.Use("blacklist", Blacklist(conf.Blacklist))
+	p.Use("indent", Indent(conf.Indent))
+	p.Use("min_length", MinLength(conf.MinLength))
+
+	return p, nil
+}
+
+// Use 在末尾添加规则，同名规则会被替换
+func (p *ContentPipeline) Use(name string, f ContentFilter) {
+	for i, nf := range p.filters {
+		if nf.name == name {
+			p.filters[i].filter = f
+			return
+		}
+	}
+
+	p.filters = append(p.filters, namedFilter{name, f})
+}
+
+// Remove 删除规则
+func (p *ContentPipeline) Remove(name string) {
+	for i, nf := range p.filters {
+		if nf.name == name {
+			p.filters = append(p.filters[:i], p.filters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Process 依次执行所有规则
+func (p *ContentPipeline) Process(ct Content) (Content, error) {
+	text := ct.Text
+
+	for _, nf := range p.filters {
+		var err error
+		if text, err = nf.filter(text); err != nil {
+			return ct, fmt.Errorf("chapter [%s] %s: %w", ct.Chapter.Url, nf.name, err)
+		}
+	}
+
+	ct.Text = text
+
+	return ct, nil
+}
+
+var (
+	brTagReg = regexp.MustCompile(`(?i)<br\s*/?>|</?p(\s[^>]*)?>`)
+)
+
+// StripHTML 把 <br> 和 <p> 转换为换行，去掉其他标签
+func StripHTML(text string) (string, error) {
+	text = brTagReg.ReplaceAllString(text, "\n")
+	return htmlTagReg.ReplaceAllString(text, ""), nil
+}
+
+// DecodeEntities 解码 HTML 实体，&nbsp; 转为普通空格
+func DecodeEntities(text string) (string, error) {
+	text = html.UnescapeString(text)
+	return strings.Replace(text, "\u00a0", " ", -1), nil
+}
+
+// RemoveAdLines 删除匹配任意一个正则的行
+func RemoveAdLines(ads []*regexp.Regexp) ContentFilter {
+	return func(text string) (string, error) {
+		lines := strings.Split(text, "\n")
+
+		kept := lines[:0]
+	next:
+		for _, line := range lines {
+			for _, reg := range ads {
+				if reg.MatchString(line) {
+					continue next
+				}
+			}
+			kept = append(kept, line)
+		}
+
+		return strings.Join(kept, "\n"), nil
+	}
+}
+
+// Blacklist 正文包含任意一个短语时不合格，如“请重新刷新页面”
+func Blacklist(phrases []string) ContentFilter {
+	return func(text string) (string, error) {
+		for _, phrase := range phrases {
+			if phrase != "" && strings.Contains(text, phrase) {
+				return text, fmt.Errorf("%w: contains %q", ErrBadContent, phrase)
+			}
+		}
+		return text, nil
+	}
+}
+
+// Indent 去掉空行，每段用 prefix 缩进
+func Indent(prefix string) ContentFilter {
+	return func(text string) (string, error) {
+		paragraphs := []string{}
+		for _, line := range strings.Split(text, "\n") {
+			line = strings.TrimFunc(line, unicode.IsSpace)
+			if line != "" {
+				paragraphs = append(paragraphs, prefix+line)
+			}
+		}
+		return strings.Join(paragraphs, "\n"), nil
+	}
+}
+
+// MinLength 去掉空白后少于 n 个字时不合格
+func MinLength(n int) ContentFilter {
+	return func(text string) (string, error) {
+		count := utf8.RuneCountInString(strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, text))
+
+		if count < n {
+			return text, fmt.Errorf("%w: %d characters, at least %d", ErrBadContent, count, n)
+		}
+		return text, nil
+	}
+}
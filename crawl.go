@@ -0,0 +1,410 @@
+// 全站目录抓取任务
+package main
+
+import (
+	"github.com/gocolly/colly"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 单个 ID 的抓取状态
+const (
+	CrawlDone   = "done"   // 已抓取到目录
+	CrawlEmpty  = "empty"  // 页面不存在或没有书籍
+	CrawlFailed = "failed" // 请求失败，需要重试
+)
+
+var (
+	bucketCrawl = []byte("crawl") // 书源 -> { state: CrawlState, ids: { ID -> 状态 } }
+	keyState    = []byte("state")
+	bucketIDs   = []byte("ids")
+)
+
+// CrawlState 抓取进度，保存在数据库中，重启后从 Cursor 之后继续
+type CrawlState struct {
+	Source    string
+	Cursor    int // 最后处理的 ID
+	Total     int
+	Done      int
+	Empty     int
+	Failed    int
+	Finished  bool
+	UpdatedAt time.Time
+}
+
+func (s CrawlState) String() string {
+	processed := s.Done + s.Empty + s.Failed
+	percent := 0.0
+	if s.Total > 0 {
+		percent = float64(processed) * 100 / float64(s.Total)
+	}
+
+	return fmt.Sprintf("[%s] %d/%d (%.1f%%) 成功 %d 空 %d 失败 %d 当前 ID %d",
+		s.Source, processed, s.Total, percent, s.Done, s.Empty, s.Failed, s.Cursor)
+}
+
+// CrawlJob 可断点续抓的全站目录抓取任务
+type CrawlJob struct {
+	sync.Mutex
+
+	lib   *Library
+	src   BookSource
+	ids   []int
+	state CrawlState
+}
+
+// NewCrawlJob 创建抓取任务，读取上次保存的进度
+func (lib *Library) NewCrawlJob(src BookSource) (*CrawlJob, error) {
+	job := &CrawlJob{
+		lib: lib,
+		src: src,
+		ids: lib.conf.CrawlIDs(src),
+	}
+
+	job.state.Source = src.Name()
+
+	exist := lib.db.IDs(src.Name())
+
+	err := lib.db.db.Update(func(tx *bolt.Tx) error {
+		b, err := job.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		if v := b.Get(keyState); v != nil {
+			if err := json.Unmarshal(v, &job.state); err != nil {
+				return err
+			}
+		}
+
+		// 已在数据库中的书籍视为已完成
+		ib := b.Bucket(bucketIDs)
+		for id := range exist {
+			if ib.Get(idKey(id)) == nil {
+				if err := ib.Put(idKey(id), []byte(CrawlDone)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	job.recount()
+
+	return job, nil
+}
+
+func idKey(id int) []byte {
+	return []byte(strconv.Itoa(id))
+}
+
+func (j *CrawlJob) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	root, err := tx.CreateBucketIfNotExists(bucketCrawl)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := root.CreateBucketIfNotExists([]byte(j.src.Name()))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = b.CreateBucketIfNotExists(bucketIDs); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// recount 按当前 ID 范围统计各状态数量
+func (j *CrawlJob) recount() {
+	status := j.statuses()
+
+	j.Lock()
+	defer j.Unlock()
+
+	j.state.Total = len(j.ids)
+	j.state.Done, j.state.Empty, j.state.Failed = 0, 0, 0
+
+	for _, id := range j.ids {
+		switch status[id] {
+		case CrawlDone:
+			j.state.Done++
+		case CrawlEmpty:
+			j.state.Empty++
+		case CrawlFailed:
+			j.state.Failed++
+		}
+	}
+}
+
+func (j *CrawlJob) statuses() map[int]string {
+	status := make(map[int]string)
+
+	j.lib.db.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(bucketCrawl)
+		if root == nil {
+			return nil
+		}
+		b := root.Bucket([]byte(j.src.Name()))
+		if b == nil {
+			return nil
+		}
+
+		return b.Bucket(bucketIDs).ForEach(func(k, v []byte) error {
+			if id, err := strconv.Atoi(string(k)); err == nil {
+				status[id] = string(v)
+			}
+			return nil
+		})
+	})
+
+	return status
+}
+
+// setStatus 保存单个 ID 的状态和进度
+func (j *CrawlJob) setStatus(id int, status string) error {
+	j.Lock()
+	j.state.Cursor = id
+	j.state.UpdatedAt = time.Now()
+	j.Unlock()
+
+	err := j.lib.db.db.Update(func(tx *bolt.Tx) error {
+		b, err := j.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		ib := b.Bucket(bucketIDs)
+
+		j.Lock()
+		defer j.Unlock()
+
+		switch string(ib.Get(idKey(id))) {
+		case CrawlDone:
+			j.state.Done--
+		case CrawlEmpty:
+			j.state.Empty--
+		case CrawlFailed:
+			j.state.Failed--
+		}
+
+		switch status {
+		case CrawlDone:
+			j.state.Done++
+		case CrawlEmpty:
+			j.state.Empty++
+		case CrawlFailed:
+			j.state.Failed++
+		}
+
+		if err := ib.Put(idKey(id), []byte(status)); err != nil {
+			return err
+		}
+
+		return j.saveState(b)
+	})
+
+	return err
+}
+
+// saveState 调用方需持有锁
+func (j *CrawlJob) saveState(b *bolt.Bucket) error {
+	data, err := json.Marshal(&j.state)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(keyState, data)
+}
+
+func (j *CrawlJob) setFinished(finished bool) error {
+	return j.lib.db.db.Update(func(tx *bolt.Tx) error {
+		b, err := j.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		j.Lock()
+		defer j.Unlock()
+
+		j.state.Finished = finished
+		j.state.UpdatedAt = time.Now()
+
+		return j.saveState(b)
+	})
+}
+
+// Progress 当前进度
+func (j *CrawlJob) Progress() CrawlState {
+	j.Lock()
+	defer j.Unlock()
+
+	return j.state
+}
+
+// CrawlProgress 读取书源保存的抓取进度，不创建任务，没有抓取过时返回 false
+func (d *CatalogDB) CrawlProgress(source string) (CrawlState, bool) {
+	state := CrawlState{Source: source}
+	found := false
+
+	d.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(bucketCrawl)
+		if root == nil {
+			return nil
+		}
+		b := root.Bucket([]byte(source))
+		if b == nil {
+			return nil
+		}
+
+		if v := b.Get(keyState); v != nil {
+			found = json.Unmarshal(v, &state) == nil
+		}
+		return nil
+	})
+
+	return state, found
+}
+
+// FailedIDs 当前 ID 范围内抓取失败的 ID
+func (j *CrawlJob) FailedIDs() []int {
+	status := j.statuses()
+
+	ids := []int{}
+	for _, id := range j.ids {
+		if status[id] == CrawlFailed {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Run 从上次的位置继续抓取，跳过已完成和确认为空的 ID
+func (j *CrawlJob) Run() error {
+	state := j.Progress()
+
+	start := 0
+	if !state.Finished {
+		for i, id := range j.ids {
+			if id == state.Cursor {
+				start = i
+				break
+			}
+		}
+	}
+
+	if err := j.setFinished(false); err != nil {
+		return err
+	}
+
+	logrus.Infof("开始抓取目录 %s", j.Progress())
+
+	status := j.statuses()
+
+	todo := []int{}
+	for _, id := range j.ids[start:] {
+		if s := status[id]; s != CrawlDone && s != CrawlEmpty {
+			todo = append(todo, id)
+		}
+	}
+
+	if err := j.crawl(todo); err != nil {
+		return err
+	}
+
+	if err := j.setFinished(true); err != nil {
+		return err
+	}
+
+	logrus.Infof("目录抓取完成 %s", j.Progress())
+
+	return nil
+}
+
+// RetryFailed 只重试失败的 ID
+func (j *CrawlJob) RetryFailed() error {
+	ids := j.FailedIDs()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	logrus.Infof("重试失败的 %d 个 ID", len(ids))
+
+	if err := j.crawl(ids); err != nil {
+		return err
+	}
+
+	logrus.Infof("重试完成 %s", j.Progress())
+
+	return nil
+}
+
+func (j *CrawlJob) crawl(ids []int) error {
+	parsed := false
+	statusCode := 0
+	var parseErr error
+
+	c := j.lib.newCatalogCollector(j.src, func(_ Catalog, err error) {
+		if err != nil {
+			parseErr = err
+			return
+		}
+		parsed = true
+	})
+	c.AllowURLRevisit = true
+
+	c.OnRequest(func(r *colly.Request) {
+		logrus.Info("访问地址：", r.AbsoluteURL(r.URL.String()))
+	})
+
+	c.OnError(func(r *colly.Response, err error) {
+		statusCode = r.StatusCode
+	})
+
+	for i, id := range ids {
+		parsed, statusCode, parseErr = false, 0, nil
+
+		url := j.src.BookURL(id)
+		err := c.Visit(url)
+
+		// 只有 404 和页面明确说明书籍不存在时才不再重试，
+		// 解析失败、验证码或封禁页面等正常返回但没有目录的页面都按失败处理
+		status := CrawlFailed
+		switch {
+		case parsed:
+			status = CrawlDone
+		case statusCode == http.StatusNotFound, errors.Is(parseErr, ErrNoBook):
+			status = CrawlEmpty
+		case err != nil:
+			logrus.Warnf("抓取【%s】失败: %v", url, err)
+		case parseErr != nil:
+			logrus.Warnf("抓取【%s】失败: %v", url, parseErr)
+		default:
+			logrus.Warnf("抓取【%s】失败: 页面中没有目录", url)
+		}
+
+		if err := j.setStatus(id, status); err != nil {
+			return err
+		}
+
+		if (i+1)%100 == 0 {
+			logrus.Infof("抓取进度 %s", j.Progress())
+		}
+	}
+
+	return nil
+}
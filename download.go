@@ -2,44 +2,51 @@ package main
 
 import (
 	"github.com/ghaoo/novel/wechat"
-	"github.com/go-gomail/gomail"
 	"github.com/gocolly/colly"
-	"github.com/gocolly/colly/extensions"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/text/encoding/simplifiedchinese"
 	"github.com/patrickmn/go-cache"
 
 	"bufio"
-	"bytes"
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 	"sort"
 	"strconv"
-	"encoding/json"
+	"sync"
 )
 
-var getreg = regexp.MustCompile(`#(.+)#(\s(?:[a-z0-9_\.-]+)@(?:[\da-z\.-]+)\.(?:[a-z\.]{2,6})$)?`)
+// #书名#[epub|txt][繁] [邮箱]
+var getreg = regexp.MustCompile(`#([^#]+)#((?:epub|txt|繁體|繁体|繁)*)(\s(?:[a-z0-9_\.-]+)@(?:[\da-z\.-]+)\.(?:[a-z\.]{2,6})$)?`)
 
 var cac = cache.New(10*time.Second, 5*time.Second)
 
-func GetBook(bot *wechat.WeChat, msg wechat.EventMsgData) {
+func GetBook(lib *Library, bot *wechat.WeChat, msg wechat.EventMsgData) {
 
 	if msg.AtMe {
 		email := ""
 		book := ""
+		format := ""
+		var conv *Converter
+		if subreg.MatchString(msg.Content) || jobreg.MatchString(msg.Content) || readreg.MatchString(msg.Content) {
+			return
+		}
+
 		if getreg.MatchString(msg.Content) {
 			bs := getreg.FindStringSubmatch(msg.Content)
 
 			book = bs[1]
-			email = bs[2]
+			if strings.Contains(bs[2], "epub") {
+				format = "epub"
+			}
+			if strings.Contains(bs[2], "繁") {
+				conv = S2T()
+			}
+			email = strings.TrimSpace(bs[3])
 		}
 
 		if book != "" {
@@ -48,334 +55,473 @@ func GetBook(bot *wechat.WeChat, msg wechat.EventMsgData) {
 				bot.SendTextMsg("请检查邮箱是否收到小说" + b.(string), msg.FromUserName)
 			}*/
 
-			fname := filepath.Join(BOOK_PATH, book)
-
-			if _, err := os.Stat(fname); err != nil {
+			cl, cands, err := lib.PickBook(pickUser(msg), book)
+			if err != nil {
+				logrus.Errorf("查找【%s】失败: %v", book, err)
+			}
 
-				if os.IsNotExist(err) {
-					// 不存在
-					bot.SendTextMsg("没有找到 《"+book+"》 这本书", msg.FromUserName)
-				}
+			if len(cands) > 0 {
+				// 同名或模糊匹配，等待用户选择
+				bot.SendTextMsg(candidateList(book, "#", cands), msg.FromUserName)
+			} else if cl.Name == "" {
+				// 不存在
+				bot.SendTextMsg("没有找到 《"+book+"》 这本书", msg.FromUserName)
 			} else {
 				// 存在
-				datafile := filepath.Join(fname, "data.json")
+				book = cl.Name
 
-				cl := Catalog{}
+				// 同一本书只下载一次，完成后发送给所有等待的人
+				job, created := lib.FetchBook(cl, false, func(job *Job) {
+					deliverBook(lib, bot, msg, job.Catalog, format, conv, email)
+				})
 
-				data, err := ioutil.ReadFile(datafile)
-				if err != nil {
-					logrus.Errorf("读取文件【%s】失败: %v", datafile, err)
+				if job == nil {
+					deliverBook(lib, bot, msg, cl, format, conv, email)
+					return
 				}
 
-				err = json.Unmarshal(data, &cl)
-				if err != nil {
-					logrus.Errorf("解析文件【%s】失败: %v", datafile, err)
+				if created {
+					bot.SendTextMsg("《"+book+"》已加入下载队列，完成后会发送给你，发送 #进度# 查看下载进度", msg.FromUserName)
+				} else {
+					bot.SendTextMsg("《"+book+"》"+lib.jobs.Status(job).String()+"，完成后会一起发送给你", msg.FromUserName)
 				}
+			}
+		}
+	}
+}
 
-				bookpath := filepath.Join(fname, book+".txt")
-
-				if _, err := os.Stat(bookpath); os.IsNotExist(err) {
+// FetchBook 书籍未下载、超过更新间隔或有缺失章节时提交下载任务，force 为 true 时总是重新检查更新；
+// 不需要下载时返回 nil，notify 在任务结束后调用
+func (lib *Library) FetchBook(cl Catalog, force bool, notify func(*Job)) (*Job, bool) {
+	// 有缺失章节时每次都重新尝试下载
+	update := force || lib.NeedsUpdate(cl) || len(lib.MissingChapters(cl)) > 0
 
-					bot.SendTextMsg("下载中，请等待几分钟后再来...", msg.FromUserName)
+	if _, err := os.Stat(lib.store.BookFile(cl, ".txt")); os.IsNotExist(err) {
+		update = true
+	}
 
-					cl = GetCatalog(fmt.Sprintf("https://www.bqg5200.com/xiaoshuo/%s/%d/", cl.SubID, cl.ID))
+	if !update {
+		return nil, false
+	}
 
-					fetchContent(&cl)
+	return lib.jobs.Submit(cl, notify)
+}
 
-					if err = fileMerge(fname); err != nil {
-						logrus.Error(err)
-					}
+// ExportBook 按格式生成已下载的书，返回文件路径。format 为 txt、epub 或 md，conv 不为空时生成对应的繁简版本；
+// 简体 txt 更新后重新生成其他版本
+func (lib *Library) ExportBook(cl Catalog, format string, conv *Converter) (string, error) {
+	store := lib.store
 
-					if err = bot.SendFile(bookpath, msg.FromUserName); err != nil {
-						if email == "" {
-							bot.SendTextMsg("文件较大，需通过邮件发送，请在小说名后面加上邮箱...", msg.FromUserName)
-						} else {
-							sendmail(email, bookpath, book)
-							cac.Set(msg.FromUserName, book, 10*time.Second)
-							bot.SendTextMsg("文件较大，已通过邮件发送...", msg.FromUserName)
-						}
-					}
+	fname := store.BookDir(cl)
 
-				} else {
+	bookpath := store.BookFile(cl, ".txt")
 
-					if err = bot.SendFile(bookpath, msg.FromUserName); err != nil {
-						if email == "" {
-							bot.SendTextMsg("文件较大，需通过邮件发送，请在小说名后面加上邮箱...", msg.FromUserName)
-						} else {
-							sendmail(email, bookpath, book)
-							cac.Set(msg.FromUserName, book, 10*time.Second)
-							bot.SendTextMsg("文件较大，已通过邮件发送...", msg.FromUserName)
-						}
-					}
-				}
-			}
-		}
+	if _, err := os.Stat(bookpath); err != nil {
+		return "", err
 	}
-}
 
-func fetchContent(cl *Catalog) {
+	srcpath := bookpath
 
-	cac.Set(cl.Name, true, 30*time.Second)
-
-	c := colly.NewCollector(
-		colly.AllowedDomains("www.bqg5200.com"),
-		//colly.DisallowedURLFilters(regexp.MustCompile(`https:\/\/m.bqg5200.com\/wapbook-753-(\d+)*`)),
-		colly.Async(true),
-	)
-
-	c.Limit(&colly.LimitRule{
-		DomainRegexp: "www.bqg5200.com/*",
-		Parallelism:  30,
-		RandomDelay:  2 * time.Second,
-	})
+	if conv != nil {
+		convpath := store.BookFile(cl, conv.Suffix()+".txt")
 
-	/*c.WithTransport(&http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		//DisableKeepAlives: true,
-	})*/
+		if needsExport(convpath, srcpath) {
+			if err := fileMerge(fname, cl.Name, conv); err != nil {
+				return "", fmt.Errorf("merge %s failed: %v", convpath, err)
+			}
+		}
 
-	extensions.RandomUserAgent(c)
+		bookpath = convpath
+	}
 
-	var reg_bqg5200 = regexp.MustCompile(`https:\/\/www.bqg5200.com\/xiaoshuo\/\d+\/\d+\/(\d+).html`)
+	if format == "epub" {
+		epubpath := store.BookFile(cl, conv.Suffix()+".epub")
 
-	c.OnHTML("body.clo_bg", func(e *colly.HTMLElement) {
+		if needsExport(epubpath, srcpath) {
+			var err error
+			if epubpath, err = exportEpub(fname, cl, conv); err != nil {
+				return "", fmt.Errorf("export %s failed: %v", epubpath, err)
+			}
+		}
 
-		upath := e.Request.URL.String()
+		bookpath = epubpath
+	}
 
-		fname := reg_bqg5200.FindStringSubmatch(upath)
+	if format == "md" {
+		mdpath := store.BookFile(cl, conv.Suffix()+".md")
 
-		h, _ := e.DOM.Html()
+		if needsExport(mdpath, srcpath) {
+			var err error
+			if mdpath, err = exportMarkdown(fname, cl, conv); err != nil {
+				return "", fmt.Errorf("export %s failed: %v", mdpath, err)
+			}
+		}
 
-		html, _ := DecodeGBK([]byte(h))
+		bookpath = mdpath
+	}
 
-		dom := e.DOM.SetHtml(string(html))
+	return bookpath, nil
+}
 
-		//class_name := dom.Find("#header .readNav :nth-child(2)").Text()
+// deliverBook 按用户要求的格式生成并发送已下载的书
+func deliverBook(lib *Library, bot *wechat.WeChat, msg wechat.EventMsgData, cl Catalog, format string, conv *Converter, email string) {
+	book := cl.Name
 
-		book_name := dom.Find("#header .readNav :nth-child(3)").Text()
+	if _, err := os.Stat(lib.store.BookFile(cl, ".txt")); os.IsNotExist(err) {
+		bot.SendTextMsg("《"+book+"》下载失败，请稍后再试...", msg.FromUserName)
+		return
+	}
 
-		title := strings.TrimSpace(dom.Find("div.title h1").Text())
+	if n := len(lib.MissingChapters(cl)); n > 0 {
+		bot.SendTextMsg(fmt.Sprintf("《%s》还有 %d 章没有下载成功，先发送已下载的部分，稍后再来可以补全", book, n), msg.FromUserName)
+	}
 
-		dom.Find("div#content div").Remove()
-		article, _ := dom.Find("div#content").Html()
-		article = strings.Replace(article, "聽", " ", -1)
-		article = strings.Replace(article, "<br/>", "\n", -1)
+	bookpath, err := lib.ExportBook(cl, format, conv)
+	if err != nil {
+		logrus.Errorf("生成【%s】失败: %v", book, err)
+		bot.SendTextMsg("生成文件失败，请稍后再试...", msg.FromUserName)
+		return
+	}
 
-		content := "### " + title + "\n" + article + "\n\n"
+	sendBook(lib, bot, msg, cl, bookpath, conv.Convert(book), email)
+}
 
-		fpath := filepath.Join(BOOK_PATH, book_name, fname[1]+".rbx")
+// sendBook 通过微信发送小说文件。文件超过大小限制或发送失败时，txt 先尝试压缩，
+// 仍然太大则分卷逐个发送，都失败时加入邮件发送队列。
+// 压缩包和分卷写入这次发送独有的临时目录，同一本书同时发送给多人时互不影响
+func sendBook(lib *Library, bot *wechat.WeChat, msg wechat.EventMsgData, cl Catalog, bookpath, book, email string) {
+	conf := lib.conf
+	to := msg.FromUserName
 
-		err := write(fpath, []byte(content))
+	if sendFile(bot, bookpath, to, conf.Send.MaxSize) {
+		return
+	}
 
+	if filepath.Ext(bookpath) == ".txt" {
+		tmp, err := ioutil.TempDir("", "novel-send-")
 		if err != nil {
-			logrus.Errorf("%v\n", err)
+			logrus.Error(err)
+			bot.SendTextMsg("生成文件失败，请稍后再试...", to)
+			return
 		}
+		defer os.RemoveAll(tmp)
 
-	})
+		if conf.Send.Zip {
+			zpath, err := ZipFile(bookpath, tmp)
+			if err != nil {
+				logrus.Errorf("压缩【%s】失败: %v", bookpath, err)
+			} else if sendFile(bot, zpath, to, conf.Send.MaxSize) {
+				return
+			}
+		}
 
-	c.OnRequest(func(r *colly.Request) {
-		//time.Sleep(getRandomDelay(1000))
-		//logrus.Infof("Visiting %s", r.URL.String())
-	})
+		parts, err := SplitTxt(bookpath, tmp, conf.Send.MaxSize, conf.Send.MaxChapters)
+		if err != nil {
+			logrus.Errorf("分卷【%s】失败: %v", bookpath, err)
+		} else if len(parts) > 1 && sendParts(bot, parts, book, to) {
+			return
+		}
+	}
 
-	bookpath := filepath.Join(BOOK_PATH, cl.Name)
+	if email == "" {
+		bot.SendTextMsg("文件较大，需通过邮件发送，请在小说名后面加上邮箱...", to)
+		return
+	}
 
-	// 检查章节是否已下载，如果已经下载跳过
-	cpts, _ := filepath.Glob(bookpath + "\\*.rbx")
+	err := lib.mail.Enqueue(NewMailJob(to, email, bookpath, book, cl))
+	if err == ErrMailTooLarge && filepath.Ext(bookpath) == ".txt" {
+		err = enqueueZip(lib, to, email, bookpath, book, cl)
+	}
 
-	exist := make(map[int]int, 0)
-	for _, fi := range cpts {
+	switch err {
+	case nil:
+		bot.SendTextMsg("文件较大，已加入邮件发送队列，发送结果会通知你...", to)
+	case ErrMailDisabled:
+		bot.SendTextMsg("文件较大，且未配置邮件发送，无法发送...", to)
+	case ErrMailTooLarge:
+		bot.SendTextMsg("文件超过邮箱附件大小限制，无法通过邮件发送...", to)
+	default:
+		logrus.Errorf("发送《%s》到 %s 失败: %v", book, email, err)
+		bot.SendTextMsg("邮件发送失败，请稍后再试...", to)
+	}
+}
 
-		if strings.HasPrefix(cl.Url, `https://www.bqg5200.com`) {
-			cpt := strings.TrimSuffix(filepath.Base(fi), ".rbx")
+// enqueueZip 把 txt 压缩到邮件独有的临时目录后加入发送队列，邮件发送结束后删除
+func enqueueZip(lib *Library, to, email, bookpath, book string, cl Catalog) error {
+	dir, err := ioutil.TempDir("", "novel-mail-")
+	if err != nil {
+		return err
+	}
 
-			if cptid, err := strconv.Atoi(cpt); err == nil {
-				exist[cptid] = cl.ID
-			}
+	zpath, err := ZipFile(bookpath, dir)
+	if err == nil {
+		job := NewMailJob(to, email, zpath, book, cl)
+		job.Temp = true
+		if err = lib.mail.Enqueue(job); err == nil {
+			return nil
+		}
+	}
 
-			/*cpt_id := reg_bqg5200.FindStringSubmatch(cl.Url)[1]
+	os.RemoveAll(dir)
+	return err
+}
 
-			if cpt == cpt_id {
+// sendFile 发送文件，maxSize 大于 0 时超过该大小的文件不发送
+func sendFile(bot *wechat.WeChat, fname, to string, maxSize int) bool {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
 
-			}*/
-		}
+	if maxSize > 0 && fi.Size() > int64(maxSize) {
+		return false
+	}
 
+	if err = bot.SendFile(fname, to); err != nil {
+		logrus.Warnf("发送【%s】失败: %v", fname, err)
+		return false
 	}
 
-	for _, cpt := range cl.Chapters {
+	return true
+}
 
-		if id, ok := exist[cpt.ID]; !ok && id == cl.ID {
-			c.Visit(cpt.Url)
+// sendParts 逐卷发送并报告进度
+func sendParts(bot *wechat.WeChat, parts []string, book, to string) bool {
+	bot.SendTextMsg(fmt.Sprintf("《%s》较大，分成 %d 卷发送...", book, len(parts)), to)
+
+	for i, part := range parts {
+		// 单章超过大小限制时该卷也会超过，仍然尝试发送
+		if !sendFile(bot, part, to, 0) {
+			bot.SendTextMsg(fmt.Sprintf("第 %d/%d 卷发送失败", i+1, len(parts)), to)
+			return false
 		}
 
+		bot.SendTextMsg(fmt.Sprintf("已发送 %d/%d 卷", i+1, len(parts)), to)
+
+		// 连续发送太快会被限制
+		time.Sleep(time.Second)
 	}
 
-	c.Wait()
+	return true
+}
 
-	cac.Delete(cl.Name)
+func (lib *Library) fetchContent(cl *Catalog) {
 
-}
+	src, err := SourceOf(*cl)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
 
-/*func fetchAllContent(root string) {
+	store := lib.store
 
-	var reg_bqg5200 = regexp.MustCompile(`https:\/\/www.bqg5200.com\/xiaoshuo\/\d+\/\d+\/(\d+).html`)
+	cac.Set(cl.Name, true, 30*time.Second)
 
-	files, _ := filepath.Glob(root + "\\*")
+	policy := lib.fetch.Policy()
 
-	for _, v := range files {
+	c := lib.fetch.Collector(src, colly.LimitRule{
+		Parallelism: policy.Parallelism,
+		RandomDelay: policy.RandomDelay,
+	}, colly.Async(true))
 
-		book := filepath.Join(v, filepath.Base(v)+".txt")
+	chapters := make(map[int]Chapter, len(cl.Chapters))
+	for _, cpt := range cl.Chapters {
+		chapters[cpt.ID] = cpt
+	}
 
-		if _, err := os.Stat(book); os.IsNotExist(err) {
-			datafile := filepath.Join(v, "data.json")
+	// 每章从提交到保存或最终失败计数一次。重试在定时器中提交，
+	// 不能在采集器空闲时和 c.Wait 同时调用，所以先等所有章节结束再等采集器
+	var pending sync.WaitGroup
 
-			cl := Catalog{}
+	// 次数用完后记录到数据库
+	fail := func(r *colly.Request, attempts int, err error) {
+		defer pending.Done()
 
-			data, err := ioutil.ReadFile(datafile)
-			if err != nil {
-				logrus.Errorf("读取文件【%s】失败: %v", datafile, err)
-			}
+		id, _ := r.Ctx.GetAny("chapter").(int)
 
-			err = json.Unmarshal(data, &cl)
-			if err != nil {
-				logrus.Errorf("解析文件【%s】失败: %v", datafile, err)
-			}
+		logrus.Warnf("下载章节【%s】失败: %v", r.URL.String(), err)
 
-			fmt.Printf("开始处理文件夹：%s \n", v)
+		f := ChapterFailure{
+			Chapter:  chapters[id],
+			Error:    err.Error(),
+			Attempts: attempts,
+			At:       time.Now(),
+		}
+		if err := lib.db.SetFailure(*cl, f); err != nil {
+			logrus.Error(err)
+		}
+	}
 
-			fetchContent(&cl)
+	// 失败后按 Backoff、2*Backoff、4*Backoff... 重试，等待放在定时器中，不占用采集器的并发
+	retry := func(r *colly.Request, err error) {
+		attempts, _ := r.Ctx.GetAny("attempts").(int)
+		attempts++
+		r.Ctx.Put("attempts", attempts)
 
-			if err = fileMerge(v); err != nil {
-				logrus.Error(err)
-			}
+		// robots.txt 禁止的页面不重试
+		if attempts > lib.conf.Download.Retries || errors.Is(err, ErrDisallowed) {
+			fail(r, attempts, err)
+			return
 		}
 
+		r.Ctx.Put("error", nil)
+		// 不合格的页面可能已被缓存，重试时直接请求
+		r.Headers.Set("Cache-Control", "no-cache")
+
+		time.AfterFunc(lib.conf.Download.Backoff<<uint(attempts-1), func() {
+			if rerr := r.Retry(); rerr != nil {
+				fail(r, attempts, err)
+			}
+		})
 	}
-}*/
 
-func fileMerge(root string) error {
-	name := filepath.Base(root)
+	c.OnHTML(src.ChapterSelector(), func(e *colly.HTMLElement) {
 
-	out_name := filepath.Join(root, name+".txt")
+		upath := e.Request.URL.String()
 
-	out_file, err := os.OpenFile(out_name, os.O_CREATE|os.O_WRONLY, 0777)
+		ct, err := src.ParseChapter(upath, e.DOM)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
 
-	if err != nil {
-		return fmt.Errorf("Can not open file %s", out_name)
-	}
+		// 不合格的正文不保存，由 OnScraped 重试
+		if ct, err = lib.content.Process(ct); err != nil {
+			e.Request.Ctx.Put("error", err)
+			return
+		}
 
-	bWriter := bufio.NewWriter(out_file)
+		content := "### " + ct.Chapter.Name + "\n" + ct.Text + "\n\n"
 
-	bWriter.Write([]byte("## " + name + "\n\n\n"))
+		err = store.WriteChapter(*cl, ct.Chapter.ID, []byte(content))
 
-	cpts := make([]string, 0)
+		if err != nil {
+			logrus.Errorf("%v\n", err)
+			return
+		}
 
-	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		e.Request.Ctx.Put("saved", true)
 
-		if !info.IsDir() && strings.HasSuffix(path, ".rbx") {
-			cpts = append(cpts, path)
+		if err = lib.db.ClearFailure(*cl, ct.Chapter.ID); err != nil {
+			logrus.Error(err)
 		}
-		return err
-	})
 
-	sort.Slice(cpts, func(i, j int) bool {
-		ci, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(cpts[i]), ".rbx"))
-		cj, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(cpts[j]), ".rbx"))
-		return  ci < cj
 	})
 
-	for _, v := range cpts {
+	c.OnRequest(func(r *colly.Request) {
+		//time.Sleep(getRandomDelay(1000))
+		//logrus.Infof("Visiting %s", r.URL.String())
+	})
 
-		fp, err := os.Open(v)
+	c.OnError(func(r *colly.Response, err error) {
+		retry(r.Request, err)
+	})
 
-		if err != nil {
-			fmt.Printf("Can not open file %v", err)
-			return err
+	// 页面正常返回但没有章节内容，如验证码页面
+	c.OnScraped(func(r *colly.Response) {
+		if saved, _ := r.Ctx.GetAny("saved").(bool); !saved {
+			err, _ := r.Ctx.GetAny("error").(error)
+			if err == nil {
+				err = fmt.Errorf("no chapter content in %s", r.Request.URL)
+			}
+			retry(r.Request, err)
+			return
 		}
+		pending.Done()
+	})
 
-		defer fp.Close()
+	// 检查章节是否已下载，如果已经下载跳过
+	exist := make(map[int]bool, 0)
+	for _, cptid := range store.Chapters(*cl) {
+		exist[cptid] = true
+	}
 
-		bReader := bufio.NewReader(fp)
+	for _, cpt := range cl.Chapters {
 
-		for {
+		if !exist[cpt.ID] {
+			ctx := colly.NewContext()
+			ctx.Put("chapter", cpt.ID)
 
-			buffer := make([]byte, 1024)
-			readCount, err := bReader.Read(buffer)
-			if err == io.EOF {
-				break
-			} else {
-				bWriter.Write(buffer[:readCount])
+			// 没有发出的请求不会触发回调
+			pending.Add(1)
+			if err := c.Request("GET", cpt.Url, nil, ctx, nil); err != nil {
+				logrus.Warnf("下载章节【%s】失败: %v", cpt.Url, err)
+				pending.Done()
 			}
-
 		}
 
-		bWriter.Write([]byte("\n\n"))
-
 	}
 
-	bWriter.Flush()
+	pending.Wait()
+	c.Wait()
 
-	return nil
-}
+	cac.Delete(cl.Name)
 
-func sendmail(to, file, name string) {
+}
 
-	m := gomail.NewMessage()
-	m.SetHeader("From", "guhao022@163.com")
-	m.SetHeader("To", to)
-	// m.SetAddressHeader("Cc", "dan@example.com", "Dan") //抄送
-	m.SetHeader("Subject", "小说: "+name) // 邮件标题
-	m.SetBody("text/html", name) // 邮件内容
-	m.Attach(file) //附件
+/*func (lib *Library) fetchAllContent() {
 
-	d := gomail.NewDialer("smtp.163.com", 25, "guhao022@163.com", "guhao_19890412")
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	if err := d.DialAndSend(m); err != nil {
-		panic(err)
-	}
-}
+	store := lib.store
 
-func write(file string, content []byte) error {
+	cls, _ := lib.db.List()
 
-	fpath := path.Join(file)
+	for _, cl := range cls {
 
-	basepath := path.Dir(fpath)
-	// 检测文件夹是否存在   若不存在  创建文件夹
-	if _, err := os.Stat(basepath); err != nil {
+		if _, err := os.Stat(store.BookFile(cl, ".txt")); os.IsNotExist(err) {
 
-		if os.IsNotExist(err) {
+			fmt.Printf("开始处理文件夹：%s \n", store.BookDir(cl))
 
-			err = os.MkdirAll(basepath, os.ModePerm)
+			lib.fetchContent(&cl)
 
-			if err != nil {
-				return err
+			if err = fileMerge(store.BookDir(cl), cl.Name, nil); err != nil {
+				logrus.Error(err)
 			}
-		} else {
-			return err
 		}
+
 	}
+}*/
+
+// fileMerge 将 root 目录下的章节按 ID 顺序合并为 <书名><后缀>.txt，conv 不为空时转换简繁
+func fileMerge(root, name string, conv *Converter) error {
+	out_name := filepath.Join(root, SafeName(name)+conv.Suffix()+".txt")
 
-	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	out_file, err := os.OpenFile(out_name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
 
 	if err != nil {
-		return err
+		return fmt.Errorf("Can not open file %s", out_name)
 	}
+	defer out_file.Close()
 
-	_, err = f.Write(content)
+	bWriter := bufio.NewWriter(out_file)
 
-	return err
-}
+	bWriter.Write([]byte("## " + conv.Convert(name) + "\n\n\n"))
 
-func DecodeGBK(s []byte) ([]byte, error) {
-	reader := simplifiedchinese.GB18030.NewDecoder().Reader(bytes.NewReader(s))
+	// 只读取这本书目录下的章节，不进入子目录
+	cpts, _ := filepath.Glob(filepath.Join(root, "*.rbx"))
 
-	return ioutil.ReadAll(reader)
+	sort.Slice(cpts, func(i, j int) bool {
+		ci, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(cpts[i]), ".rbx"))
+		cj, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(cpts[j]), ".rbx"))
+		return  ci < cj
+	})
+
+	for _, v := range cpts {
+
+		data, err := ioutil.ReadFile(v)
+
+		if err != nil {
+			fmt.Printf("Can not open file %v", err)
+			return err
+		}
+
+		bWriter.Write([]byte(conv.Convert(string(data))))
+
+		bWriter.Write([]byte("\n\n"))
+
+	}
+
+	bWriter.Flush()
+
+	return nil
 }
@@ -0,0 +1,302 @@
+// 章节下载和合并测试
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestLibrary 在临时目录中打开书库，使用不限速的抓取策略和很短的重试间隔
+func newTestLibrary(t *testing.T, dir string, mutate func(*Config)) *Library {
+	t.Helper()
+
+	conf := DefaultConfig()
+	conf.BookPath = filepath.Join(dir, "books")
+	conf.DBPath = filepath.Join(dir, "novel.db")
+	conf.Crawl.RandomDelay = 0
+	conf.Download.Retries = 2
+	conf.Download.Backoff = time.Millisecond
+
+	conf.Fetch.Policy = PolicyFast
+	fast := conf.Fetch.Policies[PolicyFast]
+	fast.Parallelism = 4
+	fast.RandomDelay = 0
+	conf.Fetch.Policies[PolicyFast] = fast
+
+	if mutate != nil {
+		mutate(conf)
+	}
+
+	lib, err := NewLibrary(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		lib.Close()
+	})
+
+	return lib
+}
+
+// fixtureServer 用 testdata/bqg5200 下的页面模拟书站，intercept 返回 true 时不再返回原页面
+type fixtureServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	hits map[string]int
+}
+
+var fixturePathReg = regexp.MustCompile(`^/xiaoshuo/\d+/\d+/(?:(\d+)\.html)?$`)
+
+func newFixtureServer(t *testing.T, intercept func(w http.ResponseWriter, r *http.Request, hit int) bool) *fixtureServer {
+	t.Helper()
+
+	fs := &fixtureServer{hits: make(map[string]int)}
+
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := fixturePathReg.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		fs.Lock()
+		fs.hits[r.URL.Path]++
+		hit := fs.hits[r.URL.Path]
+		fs.Unlock()
+
+		if intercept != nil && intercept(w, r, hit) {
+			return
+		}
+
+		name := "catalog.html"
+		if m[1] != "" {
+			name = "chapter_" + m[1] + ".html"
+		}
+
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "bqg5200", name))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(body)
+	}))
+	t.Cleanup(fs.Close)
+
+	registerFixtureSource(t, fs.URL)
+
+	return fs
+}
+
+// Hits 某个路径被请求的次数
+func (fs *fixtureServer) Hits(path string) int {
+	fs.Lock()
+	defer fs.Unlock()
+
+	return fs.hits[path]
+}
+
+// registerFixtureSource 按 bqg5200-rule 注册指向测试服务器的书源
+func registerFixtureSource(t *testing.T, base string) {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("rules", "bqg5200-rule.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := SiteRule{}
+	if err = yaml.Unmarshal(data, &rule); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := regexp.QuoteMeta(base)
+	rule.Name = "fixture"
+	rule.Domains = []string{u.Host}
+	rule.BookURL = base + "/xiaoshuo/{sub}/{id}/"
+	rule.BookPattern = `^` + prefix + `/xiaoshuo/\d+/(?P<id>\d+)/?$`
+	rule.ChapterPattern = `^` + prefix + `/xiaoshuo/\d+/\d+/(?P<id>\d+)\.html$`
+
+	src, err := NewRuleSource(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterSource(src)
+}
+
+// badChapter 只有“正在手打中”提示的章节页
+func badChapter(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<html><body class="clo_bg"><div class="title"><h1>第三章 下山</h1></div>`+
+		`<div id="content">章节内容正在手打中，请稍后再来</div></body></html>`)
+}
+
+func TestFetchContent(t *testing.T) {
+	srv := newFixtureServer(t, func(w http.ResponseWriter, r *http.Request, hit int) bool {
+		switch {
+		// 第一次请求服务器出错
+		case r.URL.Path == "/xiaoshuo/0/7/8.html" && hit == 1:
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return true
+		// 第一次返回不合格的正文
+		case r.URL.Path == "/xiaoshuo/0/7/9.html" && hit == 1:
+			badChapter(w)
+			return true
+		// 一直不合格
+		case r.URL.Path == "/xiaoshuo/0/7/10.html":
+			badChapter(w)
+			return true
+		}
+		return false
+	})
+
+	lib := newTestLibrary(t, t.TempDir(), nil)
+
+	cl := lib.GetCatalog(srv.URL + "/xiaoshuo/0/7/")
+	if cl.Name != "测试之书" || len(cl.Chapters) != 3 {
+		t.Fatalf("catalog = %+v", cl)
+	}
+
+	lib.fetchContent(&cl)
+
+	if got := lib.store.Chapters(cl); !sameInts(got, []int{8, 9}) {
+		t.Errorf("saved chapters = %v, want [8 9]", got)
+	}
+
+	retries := lib.conf.Download.Retries
+	for _, c := range []struct {
+		path string
+		want int
+	}{
+		{"/xiaoshuo/0/7/8.html", 2},
+		{"/xiaoshuo/0/7/9.html", 2},
+		{"/xiaoshuo/0/7/10.html", retries + 1},
+	} {
+		if got := srv.Hits(c.path); got != c.want {
+			t.Errorf("%s requested %d times, want %d", c.path, got, c.want)
+		}
+	}
+
+	fs, err := lib.db.Failures(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 {
+		t.Fatalf("failures = %+v, want chapter 10 only", fs)
+	}
+	if fs[0].Chapter.ID != 10 || fs[0].Attempts != retries+1 {
+		t.Errorf("failure = %+v, want chapter 10 after %d attempts", fs[0], retries+1)
+	}
+	if !strings.Contains(fs[0].Error, ErrBadContent.Error()) {
+		t.Errorf("failure error = %q, want bad content", fs[0].Error)
+	}
+
+	missing := lib.MissingChapters(cl)
+	if len(missing) != 1 || missing[0].ID != 10 {
+		t.Errorf("missing = %+v, want chapter 10", missing)
+	}
+
+	data, err := ioutil.ReadFile(lib.store.ChapterFile(cl, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "### 第一章 山门\n　　清晨的山门") {
+		t.Errorf("chapter 8 = %q", data)
+	}
+}
+
+func TestFileMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		ids   []int // 写入顺序
+		conv  *Converter
+		file  string
+		title string
+		want  []int
+	}{
+		{"numeric order", []int{10, 2, 1}, nil, "测试之书.txt", "## 测试之书", []int{1, 2, 10}},
+		{"single", []int{7}, nil, "测试之书.txt", "## 测试之书", []int{7}},
+		{"traditional", []int{3, 20, 1}, S2T(), "测试之书.zh-Hant.txt", "## 測試之書", []int{1, 3, 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+
+			for _, id := range tt.ids {
+				content := fmt.Sprintf("### 第%d章 山门\n　　正文%d\n\n", id, id)
+				if err := ioutil.WriteFile(filepath.Join(root, fmt.Sprintf("%d.rbx", id)), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 子目录中的章节不合并
+			if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(root, "sub", "5.rbx"), []byte("### 第5章\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fileMerge(root, "测试之书", tt.conv); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(root, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			text := string(data)
+
+			if !strings.HasPrefix(text, tt.title+"\n") {
+				t.Errorf("title line = %q, want %q", strings.SplitN(text, "\n", 2)[0], tt.title)
+			}
+
+			got := []int{}
+			for _, m := range regexp.MustCompile(`### 第(\d+)章`).FindAllStringSubmatch(text, -1) {
+				id := 0
+				fmt.Sscan(m[1], &id)
+				got = append(got, id)
+			}
+			if !sameInts(got, tt.want) {
+				t.Errorf("chapter order = %v, want %v", got, tt.want)
+			}
+
+			if tt.conv != nil && !strings.Contains(text, "山門") {
+				t.Errorf("text not converted:\n%s", text)
+			}
+		})
+	}
+}
+
+func sameInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,379 @@
+// EPUB 导出
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// epubChapter EPUB 中的一个章节文件
+type epubChapter struct {
+	Lang       string
+	ID         string
+	Title      string
+	Paragraphs []string
+}
+
+type epubBook struct {
+	Lang     string
+	Catalog  Catalog
+	Ident    string
+	Modified string
+	Chapters []epubChapter
+}
+
+// exportEpub 将 root 目录下的 .rbx 章节按 Catalog.Chapters 顺序打包为 <书名><后缀>.epub，
+// conv 不为空时转换书名、章节标题和正文的简繁
+func exportEpub(root string, cl Catalog, conv *Converter) (string, error) {
+	name := SafeName(cl.Name)
+
+	cl.Name = conv.Convert(cl.Name)
+	cl.Author = conv.Convert(cl.Author)
+	cl.Category = conv.Convert(cl.Category)
+
+	book := epubBook{
+		Lang:     conv.Lang(),
+		Catalog:  cl,
+		Ident:    fmt.Sprintf("urn:novel:%s:%d", cl.Source, cl.ID),
+		Modified: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+	}
+
+	for _, cpt := range epubChapterFiles(root, cl) {
+		data, err := ioutil.ReadFile(filepath.Join(root, strconv.Itoa(cpt.ID)+".rbx"))
+		if err != nil {
+			return "", err
+		}
+
+		title, paragraphs := parseRbx(string(data))
+		if cpt.Name != "" {
+			title = cpt.Name
+		}
+
+		for i := range paragraphs {
+			paragraphs[i] = conv.Convert(paragraphs[i])
+		}
+
+		book.Chapters = append(book.Chapters, epubChapter{
+			Lang:       book.Lang,
+			ID:         fmt.Sprintf("c%d", cpt.ID),
+			Title:      conv.Convert(title),
+			Paragraphs: paragraphs,
+		})
+	}
+
+	if len(book.Chapters) == 0 {
+		return "", fmt.Errorf("no chapter found in %s", root)
+	}
+
+	out_name := filepath.Join(root, name+conv.Suffix()+".epub")
+
+	buf := new(bytes.Buffer)
+	if err := book.write(buf); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(out_name, buf.Bytes(), 0666); err != nil {
+		return "", err
+	}
+
+	return out_name, nil
+}
+
+// epubChapterFiles 已下载的章节，先按目录顺序，再按 ID 顺序追加目录中没有的章节
+func epubChapterFiles(root string, cl Catalog) []Chapter {
+	files, _ := filepath.Glob(filepath.Join(root, "*.rbx"))
+
+	downloaded := make(map[int]bool, len(files))
+	for _, f := range files {
+		if id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".rbx")); err == nil {
+			downloaded[id] = true
+		}
+	}
+
+	cpts := []Chapter{}
+	for _, cpt := range cl.Chapters {
+		if downloaded[cpt.ID] {
+			cpts = append(cpts, cpt)
+			delete(downloaded, cpt.ID)
+		}
+	}
+
+	rest := []int{}
+	for id := range downloaded {
+		rest = append(rest, id)
+	}
+	sort.Ints(rest)
+
+	for _, id := range rest {
+		cpts = append(cpts, Chapter{ID: id})
+	}
+
+	return cpts
+}
+
+var htmlTagReg = regexp.MustCompile(`<[^>]+>`)
+
+// parseRbx 解析 .rbx 章节文件，第一行为 "### 标题"
+func parseRbx(s string) (string, []string) {
+	title := ""
+	lines := strings.Split(s, "\n")
+
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "### ") {
+		title = strings.TrimSpace(strings.TrimPrefix(lines[0], "### "))
+		lines = lines[1:]
+	}
+
+	paragraphs := []string{}
+	for _, line := range lines {
+		line = strings.TrimSpace(html.UnescapeString(htmlTagReg.ReplaceAllString(line, "")))
+		if line != "" {
+			paragraphs = append(paragraphs, line)
+		}
+	}
+
+	return title, paragraphs
+}
+
+func (b epubBook) write(w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	// mimetype 必须是第一个文件且不压缩
+	mw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "mimetype",
+		Method:   zip.Store,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	mw.Write([]byte("application/epub+zip"))
+
+	files := []struct {
+		name string
+		tpl  *template.Template
+		data interface{}
+	}{
+		{"META-INF/container.xml", epubContainerTpl, b},
+		{"OEBPS/content.opf", epubOpfTpl, b},
+		{"OEBPS/nav.xhtml", epubNavTpl, b},
+		{"OEBPS/toc.ncx", epubNcxTpl, b},
+		{"OEBPS/style.css", epubStyleTpl, b},
+		{"OEBPS/cover.svg", epubCoverSvgTpl, b},
+		{"OEBPS/cover.xhtml", epubCoverTpl, b},
+	}
+
+	for _, f := range files {
+		fw, err := epubCreate(zw, f.name)
+		if err != nil {
+			return err
+		}
+		if err = f.tpl.Execute(fw, f.data); err != nil {
+			return err
+		}
+	}
+
+	for _, cpt := range b.Chapters {
+		fw, err := epubCreate(zw, "OEBPS/text/"+cpt.ID+".xhtml")
+		if err != nil {
+			return err
+		}
+		if err = epubChapterTpl.Execute(fw, cpt); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func epubCreate(zw *zip.Writer, name string) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+}
+
+var epubFuncs = template.FuncMap{
+	"x": func(s string) string {
+		return html.EscapeString(s)
+	},
+	"inc": func(i int) int {
+		return i + 1
+	},
+}
+
+func epubTemplate(name, text string) *template.Template {
+	return template.Must(template.New(name).Funcs(epubFuncs).Parse(strings.TrimSpace(text) + "\n"))
+}
+
+var epubContainerTpl = epubTemplate("container", `
+<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`)
+
+var epubOpfTpl = epubTemplate("opf", `
+<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="{{.Lang}}">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">{{x .Ident}}</dc:identifier>
+    <dc:title>{{x .Catalog.Name}}</dc:title>
+    <dc:language>{{.Lang}}</dc:language>
+    {{- if .Catalog.Author}}
+    <dc:creator>{{x .Catalog.Author}}</dc:creator>
+    {{- end}}
+    {{- if .Catalog.Category}}
+    <dc:subject>{{x .Catalog.Category}}</dc:subject>
+    {{- end}}
+    {{- if .Catalog.LastUpdate}}
+    <dc:description>{{x .Catalog.LastUpdate}}</dc:description>
+    {{- end}}
+    {{- if .Catalog.Url}}
+    <dc:source>{{x .Catalog.Url}}</dc:source>
+    {{- end}}
+    <meta property="dcterms:modified">{{.Modified}}</meta>
+    <meta name="cover" content="cover-image"/>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+    <item id="cover-image" href="cover.svg" media-type="image/svg+xml" properties="cover-image"/>
+    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml" properties="svg"/>
+    {{- range .Chapters}}
+    <item id="{{.ID}}" href="text/{{.ID}}.xhtml" media-type="application/xhtml+xml"/>
+    {{- end}}
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="cover"/>
+    <itemref idref="nav"/>
+    {{- range .Chapters}}
+    <itemref idref="{{.ID}}"/>
+    {{- end}}
+  </spine>
+</package>
+`)
+
+var epubNavTpl = epubTemplate("nav", `
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{.Lang}}">
+<head>
+  <title>{{x .Catalog.Name}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>目录</h1>
+    <ol>
+      {{- range .Chapters}}
+      <li><a href="text/{{.ID}}.xhtml">{{x .Title}}</a></li>
+      {{- end}}
+    </ol>
+  </nav>
+</body>
+</html>
+`)
+
+var epubNcxTpl = epubTemplate("ncx", `
+<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="{{x .Ident}}"/>
+  </head>
+  <docTitle><text>{{x .Catalog.Name}}</text></docTitle>
+  <navMap>
+    {{- range $i, $c := .Chapters}}
+    <navPoint id="nav-{{$c.ID}}" playOrder="{{inc $i}}">
+      <navLabel><text>{{x $c.Title}}</text></navLabel>
+      <content src="text/{{$c.ID}}.xhtml"/>
+    </navPoint>
+    {{- end}}
+  </navMap>
+</ncx>
+`)
+
+var epubStyleTpl = epubTemplate("style", `
+body { margin: 0 5%; line-height: 1.6; }
+h1, h2 { text-align: center; }
+p { text-indent: 2em; margin: 0.5em 0; }
+.cover { margin: 0; padding: 0; text-align: center; }
+`)
+
+var epubCoverSvgTpl = epubTemplate("cover-svg", `
+<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="600" height="800" viewBox="0 0 600 800">
+  <rect width="600" height="800" fill="#2f3e46"/>
+  <rect x="30" y="30" width="540" height="740" fill="none" stroke="#cad2c5" stroke-width="4"/>
+  <text x="300" y="330" font-size="56" fill="#ffffff" text-anchor="middle">{{x .Catalog.Name}}</text>
+  {{- if .Catalog.Author}}
+  <text x="300" y="420" font-size="32" fill="#cad2c5" text-anchor="middle">{{x .Catalog.Author}}</text>
+  {{- end}}
+  {{- if .Catalog.Category}}
+  <text x="300" y="700" font-size="24" fill="#84a98c" text-anchor="middle">{{x .Catalog.Category}}</text>
+  {{- end}}
+</svg>
+`)
+
+var epubCoverTpl = epubTemplate("cover", `
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="{{.Lang}}">
+<head>
+  <title>{{x .Catalog.Name}}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body class="cover">
+  <svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="100%" height="100%" viewBox="0 0 600 800" preserveAspectRatio="xMidYMid meet">
+    <image width="600" height="800" xlink:href="cover.svg"/>
+  </svg>
+</body>
+</html>
+`)
+
+var epubChapterTpl = epubTemplate("chapter", `
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="{{.Lang}}">
+<head>
+  <title>{{x .Title}}</title>
+  <link rel="stylesheet" type="text/css" href="../style.css"/>
+</head>
+<body>
+  <h2>{{x .Title}}</h2>
+  {{- range .Paragraphs}}
+  <p>{{x .}}</p>
+  {{- end}}
+</body>
+</html>
+`)
+
+// needsExport 导出文件不存在或比合并后的 txt 旧时需要重新生成
+func needsExport(outpath, txtpath string) bool {
+	ei, err := os.Stat(outpath)
+	if err != nil {
+		return true
+	}
+
+	ti, err := os.Stat(txtpath)
+	if err != nil {
+		return false
+	}
+
+	return ei.ModTime().Before(ti.ModTime())
+}
@@ -0,0 +1,97 @@
+// 章节下载失败记录
+package main
+
+import (
+	bolt "go.etcd.io/bbolt"
+
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 书源:ID\x00章节ID -> ChapterFailure
+var bucketFailures = []byte("failures")
+
+// ChapterFailure 重试后仍下载失败的章节
+type ChapterFailure struct {
+	Chapter  Chapter
+	Error    string
+	Attempts int
+	At       time.Time
+}
+
+func failureKey(cl Catalog, id int) []byte {
+	return append(append(catalogKey(cl.Source, cl.ID), 0), strconv.Itoa(id)...)
+}
+
+// SetFailure 记录下载失败的章节
+func (d *CatalogDB) SetFailure(cl Catalog, f ChapterFailure) error {
+	data, err := json.Marshal(&f)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketFailures)
+		if err != nil {
+			return err
+		}
+		return b.Put(failureKey(cl, f.Chapter.ID), data)
+	})
+}
+
+// ClearFailure 章节下载成功后删除失败记录
+func (d *CatalogDB) ClearFailure(cl Catalog, id int) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketFailures)
+		if b == nil {
+			return nil
+		}
+		return b.Delete(failureKey(cl, id))
+	})
+}
+
+// Failures 书籍下载失败的章节
+func (d *CatalogDB) Failures(cl Catalog) ([]ChapterFailure, error) {
+	fs := []ChapterFailure{}
+	prefix := failureKey(cl, 0)
+	prefix = prefix[:len(prefix)-1]
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketFailures)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			f := ChapterFailure{}
+			if err := json.Unmarshal(v, &f); err != nil {
+				return err
+			}
+			fs = append(fs, f)
+		}
+
+		return nil
+	})
+
+	return fs, err
+}
+
+// MissingChapters 目录中还没有下载的章节
+func (lib *Library) MissingChapters(cl Catalog) []Chapter {
+	exist := make(map[int]bool)
+	for _, id := range lib.store.Chapters(cl) {
+		exist[id] = true
+	}
+
+	missing := []Chapter{}
+	for _, cpt := range cl.Chapters {
+		if !exist[cpt.ID] {
+			missing = append(missing, cpt)
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,380 @@
+// 抓取层
+package main
+
+import (
+	"github.com/gocolly/colly"
+	"github.com/gocolly/colly/extensions"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fetcher 所有目录和章节采集器共用的抓取层，统一管理连接、超时、Cookie、UA、按域名限速和响应缓存
+type Fetcher struct {
+	conf   FetchConfig
+	policy PolicyConfig
+
+	transport *fetchTransport
+	jar       *cookiejar.Jar
+}
+
+// FetchStats 一个域名的请求统计
+type FetchStats struct {
+	Host      string
+	Requests  int
+	Failures  int // 请求出错或状态码 >= 400
+	CacheHits int
+	Bytes     int64
+	Duration  time.Duration // 所有请求的累计耗时
+	LastError string
+}
+
+// NewFetcher 创建抓取层
+func NewFetcher(conf FetchConfig) (*Fetcher, error) {
+	policy, err := conf.ActivePolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Fetcher{conf: conf, policy: policy}
+
+	if conf.Cookies {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		f.jar = jar
+	}
+
+	proxies, err := NewProxyPool(conf.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette, err := NewCassette(conf.Cassette)
+	if err != nil {
+		return nil, err
+	}
+
+	f.transport = &fetchTransport{
+		next: &http.Transport{
+			Proxy: proxyFromContext,
+			DialContext: (&net.Dialer{
+				Timeout:   conf.DialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          conf.MaxIdleConns,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		proxies:  proxies,
+		cassette: cassette,
+		ttl:      conf.CacheTTL,
+		stats:    make(map[string]*FetchStats),
+	}
+
+	f.transport.policy = newHostPolicy(policy, f.transport.roundTrip)
+
+	if conf.CacheTTL > 0 {
+		f.transport.cache = cache.New(conf.CacheTTL, conf.CacheTTL)
+	}
+
+	return f, nil
+}
+
+// Collector 创建采集器，rule 为该类任务的默认限速，配置中按域名的限速优先
+func (f *Fetcher) Collector(src BookSource, rule colly.LimitRule, options ...func(*colly.Collector)) *colly.Collector {
+	c := colly.NewCollector(colly.AllowedDomains(src.Domains()...))
+
+	for _, opt := range options {
+		opt(c)
+	}
+
+	c.WithTransport(f.transport)
+
+	if f.conf.Timeout > 0 {
+		c.SetRequestTimeout(f.conf.Timeout)
+	}
+
+	if f.jar != nil {
+		c.SetCookieJar(f.jar)
+	} else {
+		c.DisableCookies()
+	}
+
+	// colly 使用第一条匹配的规则
+	for _, l := range f.conf.Limits {
+		err := c.Limit(&colly.LimitRule{
+			DomainGlob:  l.Domain,
+			Parallelism: l.Parallelism,
+			Delay:       l.Delay,
+			RandomDelay: l.RandomDelay,
+		})
+		if err != nil {
+			logrus.Errorf("限速规则【%s】无效: %v", l.Domain, err)
+		}
+	}
+
+	if rule.DomainGlob == "" {
+		rule.DomainGlob = "*"
+	}
+	if err := c.Limit(&rule); err != nil {
+		logrus.Error(err)
+	}
+
+	if len(f.conf.UserAgents) > 0 {
+		uas := f.conf.UserAgents
+		c.OnRequest(func(r *colly.Request) {
+			r.Headers.Set("User-Agent", uas[rand.Intn(len(uas))])
+		})
+	} else {
+		extensions.RandomUserAgent(c)
+	}
+
+	normalizeCharset(c, src.Encoding())
+
+	return c
+}
+
+// Policy 当前使用的抓取策略
+func (f *Fetcher) Policy() PolicyConfig {
+	return f.policy
+}
+
+// Stats 各域名的请求统计，按请求数排序
+func (f *Fetcher) Stats() []FetchStats {
+	return f.transport.snapshot()
+}
+
+// Proxies 代理状态，没有配置代理时为空
+func (f *Fetcher) Proxies() []ProxyStats {
+	if f.transport.proxies == nil {
+		return nil
+	}
+	return f.transport.proxies.Stats()
+}
+
+// fetchTransport 记录请求统计并缓存 GET 响应，请求头带 Cache-Control: no-cache 时跳过缓存；
+// 实际发出的请求先按抓取策略等待，配置了代理时每个请求从代理池中选一个代理；
+// 开启录制时响应保存到磁盘，回放时不访问网络也不等待
+type fetchTransport struct {
+	next     http.RoundTripper
+	proxies  *ProxyPool
+	policy   *hostPolicy
+	cassette *Cassette
+
+	ttl   time.Duration
+	cache *cache.Cache
+
+	sync.Mutex
+	stats map[string]*FetchStats
+}
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (t *fetchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	cacheable := t.cache != nil && req.Method == http.MethodGet
+	key := req.URL.String()
+
+	if cacheable && req.Header.Get("Cache-Control") != "no-cache" {
+		if v, ok := t.cache.Get(key); ok {
+			t.record(host, func(s *FetchStats) {
+				s.CacheHits++
+			})
+			return v.(*cachedResponse).response(req), nil
+		}
+	}
+
+	// 只在真正发送时执行抓取策略，录制命中不受限速影响
+	var start time.Time
+	sent := false
+	send := func(req *http.Request) (*http.Response, error) {
+		if err := t.policy.wait(req); err != nil {
+			return nil, err
+		}
+		sent = true
+		start = time.Now()
+		return t.send(req)
+	}
+
+	var resp *http.Response
+	var err error
+	if t.cassette != nil {
+		resp, err = t.cassette.roundTrip(req, send)
+	} else {
+		resp, err = send(req)
+	}
+
+	if !sent {
+		// 录制命中、回放时没有录制或 robots.txt 禁止
+		t.record(host, func(s *FetchStats) {
+			if err != nil {
+				s.Failures++
+				s.LastError = err.Error()
+			} else {
+				s.CacheHits++
+			}
+		})
+		return resp, err
+	}
+
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.record(host, func(s *FetchStats) {
+			s.Requests++
+			s.Failures++
+			s.Duration += elapsed
+			s.LastError = err.Error()
+		})
+		logrus.Debugf("抓取 %s 失败 (%v): %v", key, elapsed, err)
+		return nil, err
+	}
+
+	logrus.Debugf("抓取 %s %d (%v)", key, resp.StatusCode, elapsed)
+
+	if resp.StatusCode >= 400 {
+		t.record(host, func(s *FetchStats) {
+			s.Requests++
+			s.Failures++
+			s.Duration += elapsed
+			s.LastError = resp.Status
+		})
+		return resp, nil
+	}
+
+	if !cacheable || resp.StatusCode != http.StatusOK {
+		t.record(host, func(s *FetchStats) {
+			s.Requests++
+			s.Duration += elapsed
+			if resp.ContentLength > 0 {
+				s.Bytes += resp.ContentLength
+			}
+		})
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.record(host, func(s *FetchStats) {
+			s.Requests++
+			s.Failures++
+			s.Duration += time.Since(start)
+			s.LastError = err.Error()
+		})
+		return nil, err
+	}
+
+	t.record(host, func(s *FetchStats) {
+		s.Requests++
+		s.Duration += time.Since(start)
+		s.Bytes += int64(len(body))
+	})
+
+	cr := &cachedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+	t.cache.Set(key, cr, t.ttl)
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
+
+// roundTrip 经过录制层发送请求
+func (t *fetchTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.cassette != nil {
+		return t.cassette.roundTrip(req, t.send)
+	}
+	return t.send(req)
+}
+
+// send 通过代理发送请求，被封的响应作为错误返回，由采集器重试
+func (t *fetchTransport) send(req *http.Request) (*http.Response, error) {
+	if t.proxies == nil {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil {
+			t.policy.observe(req, resp)
+		}
+		return resp, err
+	}
+
+	ps, err := t.proxies.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(withProxy(req, ps.url))
+	if err == nil {
+		t.policy.observe(req, resp)
+		if err = t.proxies.verify(resp); err != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+	}
+
+	t.proxies.report(ps, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %v", ps.URL, err)
+	}
+
+	return resp, nil
+}
+
+func (cr *cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", cr.status, http.StatusText(cr.status)),
+		StatusCode:    cr.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cr.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(cr.body)),
+		ContentLength: int64(len(cr.body)),
+		Request:       req,
+	}
+}
+
+func (t *fetchTransport) record(host string, fn func(*FetchStats)) {
+	t.Lock()
+	defer t.Unlock()
+
+	s, ok := t.stats[host]
+	if !ok {
+		s = &FetchStats{Host: host}
+		t.stats[host] = s
+	}
+
+	fn(s)
+}
+
+func (t *fetchTransport) snapshot() []FetchStats {
+	t.Lock()
+	defer t.Unlock()
+
+	ss := make([]FetchStats, 0, len(t.stats))
+	for _, s := range t.stats {
+		ss = append(ss, *s)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Requests > ss[j].Requests
+	})
+
+	return ss
+}
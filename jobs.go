@@ -0,0 +1,301 @@
+// 下载任务队列
+package main
+
+import (
+	"github.com/ghaoo/novel/wechat"
+	"github.com/sirupsen/logrus"
+
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 任务状态
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// 已结束的任务保留多久，供查询状态
+const jobKeep = time.Hour
+
+// #进度# 或 #进度#书名
+var jobreg = regexp.MustCompile(`#进度#([^#]*)`)
+
+// Job 一本书的下载任务
+type Job struct {
+	Key      string
+	Catalog  Catalog
+	State    string
+	Err      error
+	Update   BookUpdate
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+
+	waiters []func(*Job)
+	done    chan struct{}
+}
+
+// Done 任务结束时关闭
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// JobStatus 任务状态快照
+type JobStatus struct {
+	Name     string
+	State    string
+	Percent  int // 已下载章节占目录的百分比
+	Position int // 排队中时前面的任务数
+	Err      string
+}
+
+func (s JobStatus) String() string {
+	switch s.State {
+	case JobQueued:
+		return fmt.Sprintf("排队中，前面还有 %d 本", s.Position)
+	case JobRunning:
+		return fmt.Sprintf("下载中 %d%%", s.Percent)
+	case JobDone:
+		return "已完成"
+	case JobFailed:
+		return "下载失败: " + s.Err
+	}
+	return s.State
+}
+
+// JobQueue 按书去重的下载队列，同时下载的书不超过 n 本
+type JobQueue struct {
+	sync.Mutex
+
+	lib  *Library
+	sem  chan struct{}
+	jobs map[string]*Job
+}
+
+func newJobQueue(lib *Library, n int) *JobQueue {
+	if n < 1 {
+		n = 1
+	}
+
+	return &JobQueue{
+		lib:  lib,
+		sem:  make(chan struct{}, n),
+		jobs: make(map[string]*Job),
+	}
+}
+
+// Submit 提交下载任务，同一本书已在排队或下载中时不会重复下载，返回已有任务和 false；
+// notify 在任务结束后调用
+func (q *JobQueue) Submit(cl Catalog, notify func(*Job)) (*Job, bool) {
+	key := string(catalogKey(cl.Source, cl.ID))
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.prune()
+
+	if j, ok := q.jobs[key]; ok && (j.State == JobQueued || j.State == JobRunning) {
+		if notify != nil {
+			j.waiters = append(j.waiters, notify)
+		}
+		return j, false
+	}
+
+	j := &Job{
+		Key:     key,
+		Catalog: cl,
+		State:   JobQueued,
+		Created: time.Now(),
+		done:    make(chan struct{}),
+	}
+	if notify != nil {
+		j.waiters = append(j.waiters, notify)
+	}
+
+	q.jobs[key] = j
+
+	go q.run(j)
+
+	return j, true
+}
+
+func (q *JobQueue) run(j *Job) {
+	q.sem <- struct{}{}
+
+	q.Lock()
+	j.State = JobRunning
+	j.Started = time.Now()
+	cl := j.Catalog
+	q.Unlock()
+
+	logrus.Infof("开始下载《%s》", cl.Name)
+
+	up, err := q.lib.UpdateBook(cl)
+
+	<-q.sem
+
+	q.Lock()
+	j.Update = up
+	j.Catalog = up.Catalog
+	j.Err = err
+	j.State = JobDone
+	if err != nil {
+		j.State = JobFailed
+		logrus.Errorf("下载《%s》失败: %v", cl.Name, err)
+	}
+	j.Finished = time.Now()
+	waiters := j.waiters
+	j.waiters = nil
+	q.Unlock()
+
+	close(j.done)
+
+	for _, fn := range waiters {
+		fn(j)
+	}
+}
+
+// prune 删除过期的已结束任务，调用方需持有锁
+func (q *JobQueue) prune() {
+	for key, j := range q.jobs {
+		if !j.Finished.IsZero() && time.Since(j.Finished) > jobKeep {
+			delete(q.jobs, key)
+		}
+	}
+}
+
+// Status 任务状态
+func (q *JobQueue) Status(j *Job) JobStatus {
+	q.Lock()
+	s, cl := q.status(j)
+	q.Unlock()
+
+	return q.progress(s, cl)
+}
+
+// status 复制任务状态，调用方需持有锁。下载进度需要扫描磁盘，由 progress 在解锁后计算
+func (q *JobQueue) status(j *Job) (JobStatus, Catalog) {
+	s := JobStatus{Name: j.Catalog.Name, State: j.State}
+
+	if j.Err != nil {
+		s.Err = j.Err.Error()
+	}
+
+	switch j.State {
+	case JobQueued:
+		for _, o := range q.jobs {
+			if o.State == JobQueued && o.Created.Before(j.Created) {
+				s.Position++
+			}
+		}
+	case JobDone:
+		s.Percent = 100
+	}
+
+	return s, j.Catalog
+}
+
+// progress 计算下载中任务的进度，不需要持有锁
+func (q *JobQueue) progress(s JobStatus, cl Catalog) JobStatus {
+	if s.State != JobRunning {
+		return s
+	}
+
+	if total := len(cl.Chapters); total > 0 {
+		s.Percent = (total - len(q.lib.MissingChapters(cl))) * 100 / total
+	}
+
+	return s
+}
+
+// Jobs 所有任务的状态，按提交时间排序
+func (q *JobQueue) Jobs() []JobStatus {
+	q.Lock()
+	jobs := q.sorted()
+
+	ss := make([]JobStatus, 0, len(jobs))
+	cls := make([]Catalog, 0, len(jobs))
+	for _, j := range jobs {
+		s, cl := q.status(j)
+		ss = append(ss, s)
+		cls = append(cls, cl)
+	}
+	q.Unlock()
+
+	for i := range ss {
+		ss[i] = q.progress(ss[i], cls[i])
+	}
+
+	return ss
+}
+
+// List 所有任务，按提交时间排序
+func (q *JobQueue) List() []*Job {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.sorted()
+}
+
+// sorted 清理过期任务后按提交时间排序，调用方需持有锁
+func (q *JobQueue) sorted() []*Job {
+	q.prune()
+
+	jobs := make([]*Job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Created.Before(jobs[k].Created)
+	})
+
+	return jobs
+}
+
+// Find 查找一本书最近的任务
+func (q *JobQueue) Find(cl Catalog) (*Job, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.prune()
+
+	j, ok := q.jobs[string(catalogKey(cl.Source, cl.ID))]
+	return j, ok
+}
+
+// Run 提交任务并等待完成
+func (q *JobQueue) Run(cl Catalog) *Job {
+	j, _ := q.Submit(cl, nil)
+	<-j.Done()
+	return j
+}
+
+// QueryJobs 处理 #进度# 和 #进度#书名
+func QueryJobs(lib *Library, bot *wechat.WeChat, msg wechat.EventMsgData) {
+	if !msg.AtMe || !jobreg.MatchString(msg.Content) {
+		return
+	}
+
+	book := strings.TrimSpace(jobreg.FindStringSubmatch(msg.Content)[1])
+
+	lines := []string{}
+	for _, s := range lib.jobs.Jobs() {
+		if book == "" || strings.Contains(s.Name, book) {
+			lines = append(lines, "《"+s.Name+"》"+s.String())
+		}
+	}
+
+	if len(lines) == 0 {
+		bot.SendTextMsg("当前没有下载任务", msg.FromUserName)
+		return
+	}
+
+	bot.SendTextMsg(strings.Join(lines, "\n"), msg.FromUserName)
+}
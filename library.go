@@ -0,0 +1,134 @@
+// 书库
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"os"
+	"sort"
+)
+
+// Library 书库，汇总配置、章节存储、书籍元数据库和搜索索引
+type Library struct {
+	conf  *Config
+	store *Storage
+	db    *CatalogDB
+	index *SearchIndex
+
+	fetch   *Fetcher
+	content *ContentPipeline
+	jobs    *JobQueue
+	mail    *Mailer
+}
+
+// NewLibrary 打开书库，首次打开时导入旧的 data.json
+func NewLibrary(conf *Config) (*Library, error) {
+	content, err := NewContentPipeline(conf.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	fetch, err := NewFetcher(conf.Fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := OpenCatalogDB(conf.DBPath)
+	if err != nil {
+		return nil, err
+	}
+
+	lib := &Library{
+		conf:  conf,
+		store: NewStorage(conf.BookPath),
+		db:    db,
+		index: NewSearchIndex(),
+
+		fetch:   fetch,
+		content: content,
+		mail:    NewMailer(conf.SMTP, db),
+	}
+
+	lib.jobs = newJobQueue(lib, conf.Download.Jobs)
+
+	if db.Meta("imported") == "" {
+		n, err := ImportCatalogs(db, lib.store)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		if err = db.SetMeta("imported", "1"); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		logrus.Infof("导入 data.json 共 %d 本书", n)
+	}
+
+	if db.Meta("layout") == "" {
+		n, err := MigrateBookDirs(db, lib.store)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		if err = db.SetMeta("layout", "source-id"); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		if n > 0 {
+			logrus.Infof("书籍目录改为按书源和 ID 存放，移动 %d 本书", n)
+		}
+	}
+
+	if err := lib.index.Build(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return lib, nil
+}
+
+// Close 关闭书库
+func (lib *Library) Close() error {
+	return lib.db.Close()
+}
+
+// FindBook 按书名查找书籍
+func (lib *Library) FindBook(name string) ([]Catalog, error) {
+	return lib.db.ByName(name)
+}
+
+// Downloaded 是否已合并出 txt
+func (lib *Library) Downloaded(cl Catalog) bool {
+	_, err := os.Stat(lib.store.BookFile(cl, ".txt"))
+	return err == nil
+}
+
+// DownloadedBooks 已下载的书，只读取书库中有目录的书
+func (lib *Library) DownloadedBooks() ([]Catalog, error) {
+	cls := []Catalog{}
+
+	for source, ids := range lib.store.Books() {
+		for _, id := range ids {
+			cl, err := lib.db.Get(source, id)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			if lib.Downloaded(cl) {
+				cls = append(cls, cl)
+			}
+		}
+	}
+
+	sort.Slice(cls, func(i, j int) bool {
+		return string(catalogKey(cls[i].Source, cls[i].ID)) < string(catalogKey(cls[j].Source, cls[j].ID))
+	})
+
+	return cls, nil
+}
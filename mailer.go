@@ -0,0 +1,305 @@
+// 邮件发送
+package main
+
+import (
+	"github.com/go-gomail/gomail"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ID -> MailJob
+var bucketMails = []byte("mails")
+
+var (
+	// ErrMailDisabled 未配置 SMTP 账号
+	ErrMailDisabled = errors.New("smtp account not configured")
+	// ErrMailTooLarge 附件超过邮箱限制
+	ErrMailTooLarge = errors.New("attachment exceeds mail size limit")
+)
+
+// MailJob 待发送的邮件，保存在数据库中，重启后继续发送
+type MailJob struct {
+	ID   uint64
+	User string // 微信用户，发送结果会通知给他
+	To   string
+	File string
+	Temp bool // File 为临时文件，发送结束后删除
+
+	Book        string
+	Author      string
+	Category    string
+	Source      string
+	LastChapter string
+	Chapters    int
+
+	Attempts  int
+	NextAt    time.Time
+	LastError string
+	Created   time.Time
+}
+
+// NewMailJob 根据书籍信息创建邮件
+func NewMailJob(user, to, file, book string, cl Catalog) MailJob {
+	return MailJob{
+		User:        user,
+		To:          to,
+		File:        file,
+		Book:        book,
+		Author:      cl.Author,
+		Category:    cl.Category,
+		Source:      cl.Source,
+		LastChapter: cl.LastChapter,
+		Chapters:    len(cl.Chapters),
+	}
+}
+
+// Mailer 带重试队列的邮件发送
+type Mailer struct {
+	conf   SMTPConfig
+	db     *CatalogDB
+	notify func(text, to string) error
+	wake   chan struct{}
+}
+
+// NewMailer 创建邮件发送器，调用 Start 后开始发送
+func NewMailer(conf SMTPConfig, db *CatalogDB) *Mailer {
+	return &Mailer{
+		conf: conf,
+		db:   db,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Enqueue 检查附件大小后加入发送队列
+func (m *Mailer) Enqueue(job MailJob) error {
+	if m.conf.Username == "" {
+		return ErrMailDisabled
+	}
+
+	fi, err := os.Stat(job.File)
+	if err != nil {
+		return err
+	}
+
+	// 附件按 base64 编码，体积增加三分之一
+	if m.conf.MaxSize > 0 && fi.Size()*4/3 > int64(m.conf.MaxSize) {
+		return ErrMailTooLarge
+	}
+
+	job.Created = time.Now()
+	job.NextAt = job.Created
+
+	err = m.db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketMails)
+		if err != nil {
+			return err
+		}
+
+		if job.ID, err = b.NextSequence(); err != nil {
+			return err
+		}
+
+		return putMailJob(b, job)
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func mailKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func putMailJob(b *bolt.Bucket, job MailJob) error {
+	data, err := json.Marshal(&job)
+	if err != nil {
+		return err
+	}
+	return b.Put(mailKey(job.ID), data)
+}
+
+// Pending 队列中的邮件
+func (m *Mailer) Pending() ([]MailJob, error) {
+	jobs := []MailJob{}
+
+	err := m.db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMails)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			job := MailJob{}
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+
+	return jobs, err
+}
+
+func (m *Mailer) save(job MailJob) error {
+	return m.db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketMails)
+		if err != nil {
+			return err
+		}
+		return putMailJob(b, job)
+	})
+}
+
+// remove 从队列中删除，临时附件一起删除
+func (m *Mailer) remove(job MailJob) error {
+	if job.Temp {
+		os.Remove(job.File)
+		// 临时目录中只有这个附件，不是空目录时不会删除
+		os.Remove(filepath.Dir(job.File))
+	}
+
+	return m.db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMails)
+		if b == nil {
+			return nil
+		}
+		return b.Delete(mailKey(job.ID))
+	})
+}
+
+// Start 开始处理队列，notify 用于把发送结果告诉微信用户
+func (m *Mailer) Start(notify func(text, to string) error) {
+	m.notify = notify
+
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			m.process()
+
+			select {
+			case <-ticker.C:
+			case <-m.wake:
+			}
+		}
+	}()
+}
+
+func (m *Mailer) process() {
+	jobs, err := m.Pending()
+	if err != nil {
+		logrus.Errorf("读取邮件队列失败: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if time.Now().Before(job.NextAt) {
+			continue
+		}
+
+		err := m.send(job)
+		if err == nil {
+			logrus.Infof("《%s》已发送到 %s", job.Book, job.To)
+			m.report(job, fmt.Sprintf("《%s》已发送到邮箱 %s，请注意查收", job.Book, job.To))
+			if err = m.remove(job); err != nil {
+				logrus.Error(err)
+			}
+			continue
+		}
+
+		job.Attempts++
+		job.LastError = err.Error()
+
+		// 第一次发送加上 Retries 次重试
+		logrus.Warnf("发送《%s》到 %s 失败(%d/%d): %v", job.Book, job.To, job.Attempts, m.conf.Retries+1, err)
+
+		if job.Attempts > m.conf.Retries {
+			m.report(job, fmt.Sprintf("《%s》发送到邮箱 %s 失败: %v", job.Book, job.To, err))
+			if err = m.remove(job); err != nil {
+				logrus.Error(err)
+			}
+			continue
+		}
+
+		job.NextAt = time.Now().Add(m.conf.RetryInterval << uint(job.Attempts-1))
+		if err = m.save(job); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func (m *Mailer) report(job MailJob, text string) {
+	if m.notify == nil || job.User == "" {
+		return
+	}
+
+	if err := m.notify(text, job.User); err != nil {
+		logrus.Errorf("通知 %s 失败: %v", job.User, err)
+	}
+}
+
+func (m *Mailer) send(job MailJob) error {
+	from := m.conf.From
+	if from == "" {
+		from = m.conf.Username
+	}
+
+	body := new(bytes.Buffer)
+	if err := mailTpl.Execute(body, job); err != nil {
+		return err
+	}
+
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", from)
+	msg.SetHeader("To", job.To)
+	msg.SetHeader("Subject", "小说: "+job.Book)
+	msg.SetBody("text/html", body.String())
+	msg.Attach(job.File, gomail.Rename(job.Book+filepath.Ext(job.File)))
+
+	d := gomail.NewDialer(m.conf.Host, m.conf.Port, m.conf.Username, m.conf.Password)
+	d.SSL = m.conf.SSL
+	d.TLSConfig = &tls.Config{
+		ServerName:         m.conf.Host,
+		InsecureSkipVerify: m.conf.SkipVerify,
+	}
+
+	return d.DialAndSend(msg)
+}
+
+var mailTpl = template.Must(template.New("mail").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #333;">
+  <h2>《{{.Book}}》</h2>
+  <table cellpadding="4">
+    {{- if .Author}}<tr><td>作者</td><td>{{.Author}}</td></tr>{{end}}
+    {{- if .Category}}<tr><td>分类</td><td>{{.Category}}</td></tr>{{end}}
+    {{- if .Chapters}}<tr><td>章节数</td><td>{{.Chapters}}</td></tr>{{end}}
+    {{- if .LastChapter}}<tr><td>最新章节</td><td>{{.LastChapter}}</td></tr>{{end}}
+    {{- if .Source}}<tr><td>来源</td><td>{{.Source}}</td></tr>{{end}}
+  </table>
+  <p>小说文件见附件。</p>
+</body>
+</html>
+`))
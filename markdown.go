@@ -0,0 +1,66 @@
+// Markdown 导出
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// exportMarkdown 将 root 目录下的 .rbx 章节按 Catalog.Chapters 顺序导出为 <书名><后缀>.md，
+// 书名为一级标题，章节为二级标题，conv 不为空时转换简繁
+func exportMarkdown(root string, cl Catalog, conv *Converter) (string, error) {
+	name := SafeName(cl.Name)
+
+	cpts := epubChapterFiles(root, cl)
+	if len(cpts) == 0 {
+		return "", fmt.Errorf("no chapter found in %s", root)
+	}
+
+	out_name := filepath.Join(root, name+conv.Suffix()+".md")
+
+	f, err := os.OpenFile(out_name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	fmt.Fprintf(w, "# %s\n\n", conv.Convert(cl.Name))
+	if cl.Author != "" {
+		fmt.Fprintf(w, "%s\n", conv.Convert("- 作者："+cl.Author))
+	}
+	if cl.Category != "" {
+		fmt.Fprintf(w, "%s\n", conv.Convert("- 分类："+cl.Category))
+	}
+	if cl.Url != "" {
+		fmt.Fprintf(w, "%s<%s>\n", conv.Convert("- 来源："), cl.Url)
+	}
+
+	for _, cpt := range cpts {
+		data, err := ioutil.ReadFile(filepath.Join(root, strconv.Itoa(cpt.ID)+".rbx"))
+		if err != nil {
+			return "", err
+		}
+
+		title, paragraphs := parseRbx(string(data))
+		if cpt.Name != "" {
+			title = cpt.Name
+		}
+
+		fmt.Fprintf(w, "\n## %s\n", conv.Convert(title))
+		for _, p := range paragraphs {
+			fmt.Fprintf(w, "\n%s\n", conv.Convert(p))
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+
+	return out_name, nil
+}
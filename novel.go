@@ -3,15 +3,24 @@ package main
 import (
 	"github.com/ghaoo/novel/wechat"
 	"github.com/sirupsen/logrus"
+
+	"net/http"
+	"os"
 )
 
-const BOOK_PATH = `E:\data\books`
+const CONFIG_FILE = `novel.yml`
 
 func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// runBot 启动微信机器人、订阅推送、邮件队列和 HTTP 接口，crawl 为 true 时在后台抓取全站目录
+func runBot(lib *Library, crawl bool) error {
+	conf := lib.conf
 
-	bot, err := wechat.NewBot(nil)
+	bot, err := wechat.NewBot(conf.WeChatConfigure())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	assistant := NewAssistant(bot)
@@ -20,16 +29,48 @@ func main() {
 		data := evt.Data.(wechat.EventMsgData)
 		go assistant.handle(data)
 
-		go GetBook(bot, data)
+		go GetBook(lib, bot, data)
+
+		go Subscribe(lib, bot, data)
+
+		go QueryJobs(lib, bot, data)
+
+		go Read(lib, bot, data)
 
 	})
 
-	//go fetchAllContent(BOOK_PATH)
-	go FetchCatalog()
+	if conf.Subscribe.Interval > 0 {
+		bot.AddTimer(conf.Subscribe.Interval)
+		bot.Handle(`/timer/`+conf.Subscribe.Interval.String(), func(evt wechat.Event) {
+			if bot.IsLogin {
+				go lib.PushSubscriptions(bot)
+			}
+		})
+	}
+
+	lib.mail.Start(bot.SendTextMsg)
+
+	if conf.HTTP.Addr != "" {
+		go func() {
+			logrus.Infof("HTTP 接口监听 %s", conf.HTTP.Addr)
+			if err := http.ListenAndServe(conf.HTTP.Addr, NewAPI(lib)); err != nil {
+				logrus.Errorf("HTTP 接口启动失败: %v", err)
+			}
+		}()
+	}
+
+	if crawl {
+		src, err := conf.CrawlSource()
+		if err != nil {
+			return err
+		}
+
+		go lib.FetchCatalog(src)
+	}
 
 	/*bot.AddTiming(`18:00`)
 	bot.Handle(`/timing/18:00`, func(arg2 wechat.Event) {
-		go FetchCatalog()
+		go lib.FetchCatalog(src)
 		bot.SendTextMsg(`9:00 了`, `filehelper`)
 	})*/
 
@@ -81,6 +122,8 @@ func main() {
 	})*/
 
 	bot.Go()
+
+	return nil
 }
 
 func init() {
@@ -0,0 +1,387 @@
+// OPDS 书目
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	opdsNavigation  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsSearch      = "application/opensearchdescription+xml"
+
+	// 每页书籍数
+	opdsPageSize = 50
+)
+
+// 从 LastUpdate 中取出日期，如 “更新时间：2019-05-20 12:30”
+var updateTimeReg = regexp.MustCompile(`(\d{4})[-/.年](\d{1,2})[-/.月](\d{1,2})日?(?:\s+(\d{1,2}):(\d{2})(?::(\d{2}))?)?`)
+
+type opdsFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []opdsLink  `xml:"link"`
+	Entries []opdsEntry `xml:"entry"`
+}
+
+type opdsLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type opdsEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Authors    []opdsAuthor   `xml:"author"`
+	Categories []opdsCategory `xml:"category"`
+	Content    *opdsContent   `xml:"content,omitempty"`
+	Links      []opdsLink     `xml:"link"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+}
+
+type opdsCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type opdsContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type openSearchDescription struct {
+	XMLName        xml.Name      `xml:"OpenSearchDescription"`
+	Xmlns          string        `xml:"xmlns,attr"`
+	ShortName      string        `xml:"ShortName"`
+	Description    string        `xml:"Description"`
+	InputEncoding  string        `xml:"InputEncoding"`
+	OutputEncoding string        `xml:"OutputEncoding"`
+	Url            openSearchURL `xml:"Url"`
+}
+
+// openSearchURL OpenSearch 1.1 的搜索地址，{searchTerms} 由客户端替换
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+// opds /opds 下的 OPDS 1.2 书目，只包含已下载的书
+func (api *API) opds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/opds":
+		api.opdsRoot(w)
+	case "/opds/recent":
+		api.opdsBooks(w, r, "recent", "最近更新", nil)
+	case "/opds/categories":
+		api.opdsGroups(w, "categories", "分类", "/opds/category", func(cl Catalog) string {
+			return cl.Category
+		})
+	case "/opds/category":
+		name := q.Get("name")
+		api.opdsBooks(w, r, "category:"+name, "分类："+name, func(cl Catalog) bool {
+			return cl.Category == name
+		})
+	case "/opds/authors":
+		api.opdsGroups(w, "authors", "作者", "/opds/author", func(cl Catalog) string {
+			return cl.Author
+		})
+	case "/opds/author":
+		name := q.Get("name")
+		api.opdsBooks(w, r, "author:"+name, "作者："+name, func(cl Catalog) bool {
+			return cl.Author == name
+		})
+	case "/opds/search.xml":
+		api.opdsSearchDescription(w)
+	case "/opds/search":
+		api.opdsSearch(w, r)
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (api *API) opdsRoot(w http.ResponseWriter) {
+	now := opdsTime(time.Now())
+
+	feed := newOPDSFeed("root", "小说书库", opdsNavigation, "/opds")
+
+	nav := []struct{ id, title, desc, href, kind string }{
+		{"recent", "最近更新", "按更新时间排列的书", "/opds/recent", opdsAcquisition},
+		{"categories", "分类", "按分类浏览", "/opds/categories", opdsNavigation},
+		{"authors", "作者", "按作者浏览", "/opds/authors", opdsNavigation},
+	}
+
+	for _, n := range nav {
+		feed.Entries = append(feed.Entries, opdsEntry{
+			Title:   n.title,
+			ID:      "urn:novel:" + n.id,
+			Updated: now,
+			Content: &opdsContent{Type: "text", Text: n.desc},
+			Links:   []opdsLink{{Rel: "subsection", Href: n.href, Type: n.kind}},
+		})
+	}
+
+	writeOPDS(w, opdsNavigation, feed)
+}
+
+// opdsGroups 按分类或作者分组的导航，书多的排在前面
+func (api *API) opdsGroups(w http.ResponseWriter, id, title, href string, key func(Catalog) string) {
+	cls, err := api.lib.DownloadedBooks()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	counts := map[string]int{}
+	for _, cl := range cls {
+		if k := key(cl); k != "" {
+			counts[k]++
+		}
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	now := opdsTime(time.Now())
+	feed := newOPDSFeed(id, title, opdsNavigation, "/opds/"+id)
+
+	for _, name := range names {
+		feed.Entries = append(feed.Entries, opdsEntry{
+			Title:   name,
+			ID:      "urn:novel:" + id + ":" + name,
+			Updated: now,
+			Content: &opdsContent{Type: "text", Text: fmt.Sprintf("%d 本", counts[name])},
+			Links: []opdsLink{{
+				Rel:  "subsection",
+				Href: href + "?name=" + neturl.QueryEscape(name),
+				Type: opdsAcquisition,
+			}},
+		})
+	}
+
+	writeOPDS(w, opdsNavigation, feed)
+}
+
+// opdsBooks 按更新时间倒序分页列出书籍，filter 为空时列出全部
+func (api *API) opdsBooks(w http.ResponseWriter, r *http.Request, id, title string, filter func(Catalog) bool) {
+	cls, err := api.lib.DownloadedBooks()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	books := []Catalog{}
+	for _, cl := range cls {
+		if filter == nil || filter(cl) {
+			books = append(books, cl)
+		}
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		return updateTime(books[i]).After(updateTime(books[j]))
+	})
+
+	api.writeBooks(w, r, id, title, books)
+}
+
+func (api *API) opdsSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		httpError(w, http.StatusBadRequest, "missing query")
+		return
+	}
+
+	books := []Catalog{}
+	for _, cl := range api.lib.Search(query, 200) {
+		if api.lib.Downloaded(cl) {
+			books = append(books, cl)
+		}
+	}
+
+	api.writeBooks(w, r, "search:"+query, "搜索："+query, books)
+}
+
+func (api *API) opdsSearchDescription(w http.ResponseWriter) {
+	desc := openSearchDescription{
+		Xmlns:          "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:      "novel",
+		Description:    "按书名、作者或拼音搜索已下载的书",
+		InputEncoding:  "UTF-8",
+		OutputEncoding: "UTF-8",
+		Url: openSearchURL{
+			Type:     opdsAcquisition,
+			Template: "/opds/search?q={searchTerms}",
+		},
+	}
+
+	writeOPDS(w, opdsSearch, desc)
+}
+
+// writeBooks 输出一页书籍，page 从 1 开始
+func (api *API) writeBooks(w http.ResponseWriter, r *http.Request, id, title string, books []Catalog) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	self := r.URL.Path
+	if name := r.URL.Query().Get("name"); name != "" {
+		self += "?name=" + neturl.QueryEscape(name)
+	} else if q := r.URL.Query().Get("q"); q != "" {
+		self += "?q=" + neturl.QueryEscape(q)
+	}
+
+	feed := newOPDSFeed(id, title, opdsAcquisition, pageURL(self, page))
+
+	if page > 1 {
+		feed.Links = append(feed.Links, opdsLink{Rel: "first", Href: pageURL(self, 1), Type: opdsAcquisition})
+		feed.Links = append(feed.Links, opdsLink{Rel: "previous", Href: pageURL(self, page-1), Type: opdsAcquisition})
+	}
+	if page*opdsPageSize < len(books) {
+		feed.Links = append(feed.Links, opdsLink{Rel: "next", Href: pageURL(self, page+1), Type: opdsAcquisition})
+	}
+
+	from := (page - 1) * opdsPageSize
+	if from > len(books) {
+		from = len(books)
+	}
+	to := from + opdsPageSize
+	if to > len(books) {
+		to = len(books)
+	}
+
+	for _, cl := range books[from:to] {
+		feed.Entries = append(feed.Entries, bookEntry(cl))
+	}
+
+	writeOPDS(w, opdsAcquisition, feed)
+}
+
+func pageURL(self string, page int) string {
+	if page <= 1 {
+		return self
+	}
+
+	sep := "?"
+	if strings.Contains(self, "?") {
+		sep = "&"
+	}
+
+	return self + sep + "page=" + strconv.Itoa(page)
+}
+
+// bookEntry 书籍条目，提供 epub 和 txt 的下载链接
+func bookEntry(cl Catalog) opdsEntry {
+	file := fmt.Sprintf("/api/books/%s/%d/file", neturl.PathEscape(cl.Source), cl.ID)
+
+	summary := fmt.Sprintf("共 %d 章", len(cl.Chapters))
+	if cl.LastChapter != "" {
+		summary += "，最新章节：" + cl.LastChapter
+	}
+	if cl.LastUpdate != "" {
+		summary += "，" + cl.LastUpdate
+	}
+
+	e := opdsEntry{
+		Title:   cl.Name,
+		ID:      fmt.Sprintf("urn:novel:book:%s:%d", cl.Source, cl.ID),
+		Updated: opdsTime(updateTime(cl)),
+		Content: &opdsContent{Type: "text", Text: summary},
+		Links: []opdsLink{
+			{Rel: "http://opds-spec.org/acquisition", Href: file + "?format=epub", Type: "application/epub+zip", Title: "EPUB"},
+			{Rel: "http://opds-spec.org/acquisition", Href: file + "?format=txt", Type: "text/plain", Title: "TXT"},
+			{Rel: "http://opds-spec.org/acquisition", Href: file + "?format=epub&lang=zh-Hant", Type: "application/epub+zip", Title: "EPUB 繁體"},
+		},
+	}
+
+	if cl.Author != "" {
+		e.Authors = []opdsAuthor{{Name: cl.Author}}
+	}
+
+	if cl.Category != "" {
+		e.Categories = []opdsCategory{{Term: cl.Category, Label: cl.Category}}
+	}
+
+	return e
+}
+
+func newOPDSFeed(id, title, kind, self string) *opdsFeed {
+	return &opdsFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		ID:      "urn:novel:" + id,
+		Title:   title,
+		Updated: opdsTime(time.Now()),
+		Links: []opdsLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigation},
+			{Rel: "search", Href: "/opds/search.xml", Type: opdsSearch},
+		},
+	}
+}
+
+// updateTime 书源提供的最后更新时间，无法识别时使用最后检查更新的时间
+func updateTime(cl Catalog) time.Time {
+	m := updateTimeReg.FindStringSubmatch(cl.LastUpdate)
+	if m == nil {
+		return cl.CheckedAt
+	}
+
+	n := make([]int, 6)
+	for i, s := range m[1:] {
+		n[i], _ = strconv.Atoi(s)
+	}
+
+	return time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], 0, time.Local)
+}
+
+func opdsTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func writeOPDS(w http.ResponseWriter, kind string, v interface{}) {
+	w.Header().Set("Content-Type", kind+";charset=utf-8")
+
+	w.Write([]byte(xml.Header))
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logrus.Error(err)
+	}
+}
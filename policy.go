@@ -0,0 +1,222 @@
+// 抓取礼仪
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/temoto/robotstxt"
+
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 抓取策略
+const (
+	PolicyPolite = "polite"
+	PolicyFast   = "fast"
+)
+
+// 匹配 robots.txt 中的 User-agent
+const robotsAgent = "novel"
+
+// robots.txt 的缓存时间，获取失败时较快重试
+const (
+	robotsTTL      = 24 * time.Hour
+	robotsRetryTTL = 10 * time.Minute
+)
+
+// ErrDisallowed robots.txt 禁止抓取
+var ErrDisallowed = errors.New("disallowed by robots.txt")
+
+// hostPolicy 按域名执行抓取策略：robots.txt、Crawl-delay、每分钟请求数和 429/503 后的退避，
+// 由所有采集器共享
+type hostPolicy struct {
+	conf PolicyConfig
+
+	// 获取 robots.txt，不经过策略限制
+	fetch func(*http.Request) (*http.Response, error)
+
+	sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	sync.Mutex
+
+	// 获取 robots.txt 时不阻塞 observe
+	robotsLock sync.Mutex
+	robots     *robotstxt.Group
+	robotsExp  time.Time
+
+	next    time.Time     // 下一个请求最早的发送时间
+	backoff time.Duration // 当前退避时间，成功后减半
+}
+
+func newHostPolicy(conf PolicyConfig, fetch func(*http.Request) (*http.Response, error)) *hostPolicy {
+	return &hostPolicy{
+		conf:  conf,
+		fetch: fetch,
+		hosts: make(map[string]*hostState),
+	}
+}
+
+func (p *hostPolicy) host(key string) *hostState {
+	p.Lock()
+	defer p.Unlock()
+
+	h, ok := p.hosts[key]
+	if !ok {
+		h = &hostState{}
+		p.hosts[key] = h
+	}
+
+	return h
+}
+
+// wait 检查 robots.txt 并等到该域名可以发送下一个请求
+func (p *hostPolicy) wait(req *http.Request) error {
+	h := p.host(req.URL.Host)
+
+	interval := time.Duration(0)
+	if p.conf.RequestsPerMinute > 0 {
+		interval = time.Minute / time.Duration(p.conf.RequestsPerMinute)
+	}
+
+	if p.conf.Robots {
+		h.robotsLock.Lock()
+		group := p.robots(h, req)
+		h.robotsLock.Unlock()
+
+		if group != nil {
+			if !group.Test(req.URL.RequestURI()) {
+				return ErrDisallowed
+			}
+			if group.CrawlDelay > interval {
+				interval = group.CrawlDelay
+			}
+		}
+	}
+
+	h.Lock()
+
+	now := time.Now()
+	slot := h.next
+	if slot.Before(now) {
+		slot = now
+	}
+	h.next = slot.Add(interval)
+
+	h.Unlock()
+
+	if d := slot.Sub(now); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-req.Context().Done():
+			return req.Context().Err()
+		}
+	}
+
+	return nil
+}
+
+// robots 读取缓存的 robots.txt 规则，过期后重新获取。调用方需持有 h.robotsLock
+func (p *hostPolicy) robots(h *hostState, req *http.Request) *robotstxt.Group {
+	if time.Now().Before(h.robotsExp) {
+		return h.robots
+	}
+
+	url := req.URL.Scheme + "://" + req.URL.Host + "/robots.txt"
+
+	h.robots = nil
+	h.robotsExp = time.Now().Add(robotsRetryTTL)
+
+	rreq, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil
+	}
+	rreq = rreq.WithContext(req.Context())
+	rreq.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+
+	resp, err := p.fetch(rreq)
+	if err != nil {
+		logrus.Warnf("获取 %s 失败: %v", url, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	data, err := robotstxt.FromResponse(resp)
+	if err != nil {
+		logrus.Warnf("解析 %s 失败: %v", url, err)
+		return nil
+	}
+
+	h.robots = data.FindGroup(robotsAgent)
+	if resp.StatusCode < 500 {
+		h.robotsExp = time.Now().Add(robotsTTL)
+	}
+
+	if h.robots.CrawlDelay > 0 {
+		logrus.Infof("%s Crawl-delay: %v", req.URL.Host, h.robots.CrawlDelay)
+	}
+
+	return h.robots
+}
+
+// observe 根据响应调整退避时间：429 和 503 时翻倍并暂停该域名，优先使用 Retry-After，成功后减半
+func (p *hostPolicy) observe(req *http.Request, resp *http.Response) {
+	if p.conf.Backoff <= 0 {
+		return
+	}
+
+	h := p.host(req.URL.Host)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		h.backoff /= 2
+		if h.backoff < p.conf.Backoff {
+			h.backoff = 0
+		}
+		return
+	}
+
+	if h.backoff == 0 {
+		h.backoff = p.conf.Backoff
+	} else {
+		h.backoff *= 2
+	}
+	if p.conf.MaxBackoff > 0 && h.backoff > p.conf.MaxBackoff {
+		h.backoff = p.conf.MaxBackoff
+	}
+
+	pause := h.backoff
+	if d := retryAfter(resp.Header.Get("Retry-After")); d > pause {
+		pause = d
+	}
+
+	if next := time.Now().Add(pause); next.After(h.next) {
+		h.next = next
+	}
+
+	logrus.Warnf("%s 返回 %s，暂停 %v", req.URL.Host, resp.Status, pause)
+}
+
+// retryAfter 解析 Retry-After，支持秒数和 HTTP 日期
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
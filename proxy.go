@@ -0,0 +1,299 @@
+// 代理池
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 代理轮换方式
+const (
+	ProxyRoundRobin = "round_robin"
+	ProxyRandom     = "random"
+)
+
+// ErrNoProxy 所有代理都已停用
+var ErrNoProxy = errors.New("no available proxy")
+
+type proxyKey struct{}
+
+// ProxyStats 一个代理的状态
+type ProxyStats struct {
+	URL       string
+	Dead      bool
+	Failures  int // 连续失败次数
+	Requests  int
+	Errors    int
+	LastError string
+	DeadAt    time.Time
+}
+
+type proxyState struct {
+	url      *neturl.URL
+	client   *http.Client // 重新检查时使用，每个代理共用一个连接池
+	checking bool
+	ProxyStats
+}
+
+// ProxyPool 代理池，连续失败或被封的代理会停用，过一段时间后重新检查
+type ProxyPool struct {
+	sync.Mutex
+
+	conf    ProxyConfig
+	proxies []*proxyState
+	next    int
+	bans    []*regexp.Regexp
+	status  map[int]bool
+}
+
+// NewProxyPool 从配置和代理文件加载代理，没有代理时返回 nil
+func NewProxyPool(conf ProxyConfig) (*ProxyPool, error) {
+	list := append([]string{}, conf.List...)
+
+	if conf.File != "" {
+		lines, err := readProxyFile(conf.File)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, lines...)
+	}
+
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	// 为 0 时重新启用的代理失败次数会变成负数
+	if conf.MaxFailures < 1 {
+		conf.MaxFailures = 1
+	}
+
+	p := &ProxyPool{
+		conf:   conf,
+		status: make(map[int]bool),
+	}
+
+	for _, s := range list {
+		if !strings.Contains(s, "://") {
+			s = "http://" + s
+		}
+
+		u, err := neturl.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %v", s, err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %s", u.Scheme)
+		}
+
+		p.proxies = append(p.proxies, &proxyState{
+			url: u,
+			client: &http.Client{
+				Timeout:   30 * time.Second,
+				Transport: &http.Transport{Proxy: http.ProxyURL(u)},
+			},
+			ProxyStats: ProxyStats{URL: u.Redacted()},
+		})
+	}
+
+	for _, pattern := range conf.BanPatterns {
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ban pattern %s: %v", pattern, err)
+		}
+		p.bans = append(p.bans, reg)
+	}
+
+	for _, code := range conf.BanStatus {
+		p.status[code] = true
+	}
+
+	logrus.Infof("加载代理 %d 个", len(p.proxies))
+
+	return p, nil
+}
+
+// readProxyFile 每行一个代理，忽略空行和 # 开头的注释
+func readProxyFile(fname string) ([]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			list = append(list, line)
+		}
+	}
+
+	return list, scanner.Err()
+}
+
+// pick 按配置的方式选择一个可用代理，到期的停用代理会重新检查
+func (p *ProxyPool) pick() (*proxyState, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	alive := []*proxyState{}
+	for _, ps := range p.proxies {
+		if ps.Dead && time.Since(ps.DeadAt) >= p.conf.RecheckInterval {
+			p.recheck(ps)
+		}
+		if !ps.Dead {
+			alive = append(alive, ps)
+		}
+	}
+
+	if len(alive) == 0 {
+		return nil, ErrNoProxy
+	}
+
+	if p.conf.Mode == ProxyRandom {
+		return alive[rand.Intn(len(alive))], nil
+	}
+
+	p.next = (p.next + 1) % len(alive)
+	return alive[p.next], nil
+}
+
+// recheck 没有检查地址时直接恢复，再失败一次就会停用；否则在后台访问检查地址，成功后恢复。调用方需持有锁
+func (p *ProxyPool) recheck(ps *proxyState) {
+	if p.conf.CheckURL == "" {
+		ps.Dead = false
+		ps.Failures = p.conf.MaxFailures - 1
+		logrus.Infof("重新启用代理 %s", ps.URL)
+		return
+	}
+
+	if ps.checking {
+		return
+	}
+	ps.checking = true
+
+	go func() {
+		err := p.check(ps.client)
+
+		p.Lock()
+		defer p.Unlock()
+
+		ps.checking = false
+		if err != nil {
+			ps.DeadAt = time.Now()
+			ps.LastError = err.Error()
+			logrus.Debugf("代理 %s 仍不可用: %v", ps.URL, err)
+			return
+		}
+
+		ps.Dead = false
+		ps.Failures = 0
+		logrus.Infof("代理 %s 已恢复", ps.URL)
+	}()
+}
+
+func (p *ProxyPool) check(client *http.Client) error {
+	resp, err := client.Get(p.conf.CheckURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("check %s: %s", p.conf.CheckURL, resp.Status)
+	}
+
+	return nil
+}
+
+// verify 检查响应是否被封，需要匹配正文时读出正文后放回
+func (p *ProxyPool) verify(resp *http.Response) error {
+	if p.status[resp.StatusCode] {
+		return fmt.Errorf("banned: %s", resp.Status)
+	}
+
+	if len(p.bans) == 0 {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for _, reg := range p.bans {
+		if reg.Match(body) {
+			return fmt.Errorf("banned: response matches %s", reg)
+		}
+	}
+
+	return nil
+}
+
+// report 记录请求结果，连续失败 MaxFailures 次后停用
+func (p *ProxyPool) report(ps *proxyState, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	ps.Requests++
+
+	if err == nil {
+		ps.Failures = 0
+		return
+	}
+
+	ps.Errors++
+	ps.Failures++
+	ps.LastError = err.Error()
+
+	if !ps.Dead && ps.Failures >= p.conf.MaxFailures {
+		ps.Dead = true
+		ps.DeadAt = time.Now()
+		logrus.Warnf("代理 %s 连续失败 %d 次，暂停使用: %v", ps.URL, ps.Failures, err)
+	}
+}
+
+// Stats 所有代理的状态
+func (p *ProxyPool) Stats() []ProxyStats {
+	p.Lock()
+	defer p.Unlock()
+
+	ss := make([]ProxyStats, 0, len(p.proxies))
+	for _, ps := range p.proxies {
+		ss = append(ss, ps.ProxyStats)
+	}
+
+	return ss
+}
+
+// proxyFromContext 供 http.Transport 使用，请求没有指定代理时使用环境变量中的代理
+func proxyFromContext(req *http.Request) (*neturl.URL, error) {
+	if u, ok := req.Context().Value(proxyKey{}).(*neturl.URL); ok {
+		return u, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+func withProxy(req *http.Request, u *neturl.URL) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), proxyKey{}, u))
+}
@@ -0,0 +1,284 @@
+// 代理池测试
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProxy 代替 HTTP 代理直接返回响应，banned 为 true 时返回 403
+type testProxy struct {
+	*httptest.Server
+
+	sync.Mutex
+	hits   int
+	banned bool
+}
+
+func newTestProxy(t *testing.T) *testProxy {
+	t.Helper()
+
+	tp := &testProxy{}
+	tp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tp.Lock()
+		tp.hits++
+		banned := tp.banned
+		tp.Unlock()
+
+		if banned {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok " + r.URL.String()))
+	}))
+	t.Cleanup(tp.Close)
+
+	return tp
+}
+
+func (tp *testProxy) Hits() int {
+	tp.Lock()
+	defer tp.Unlock()
+	return tp.hits
+}
+
+func (tp *testProxy) SetBanned(banned bool) {
+	tp.Lock()
+	tp.banned = banned
+	tp.Unlock()
+}
+
+// newProxyClient 经过代理池发送请求的客户端
+func newProxyClient(t *testing.T, mutate func(*ProxyConfig), proxies ...*testProxy) (*http.Client, *Fetcher) {
+	t.Helper()
+
+	conf := DefaultConfig().Fetch
+	conf.Policy = PolicyFast
+	conf.Policies = map[string]PolicyConfig{PolicyFast: {}}
+	conf.Cookies = false
+
+	conf.Proxy.List = nil
+	for _, tp := range proxies {
+		conf.Proxy.List = append(conf.Proxy.List, tp.URL)
+	}
+	conf.Proxy.MaxFailures = 2
+	if mutate != nil {
+		mutate(&conf.Proxy)
+	}
+
+	f, err := NewFetcher(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Transport: f.transport, Timeout: 5 * time.Second}, f
+}
+
+// get 请求一次，返回是否成功
+func get(client *http.Client) bool {
+	resp, err := client.Get("http://novel.invalid/book")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func proxyDead(f *Fetcher, tp *testProxy) bool {
+	for _, s := range f.Proxies() {
+		if s.URL == tp.URL {
+			return s.Dead
+		}
+	}
+	return false
+}
+
+func TestProxyRotation(t *testing.T) {
+	tests := []struct {
+		mode string
+		even bool // 轮流使用时每个代理的请求数相同
+	}{
+		{ProxyRoundRobin, true},
+		{ProxyRandom, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			a, b, c := newTestProxy(t), newTestProxy(t), newTestProxy(t)
+			client, _ := newProxyClient(t, func(conf *ProxyConfig) {
+				conf.Mode = tt.mode
+			}, a, b, c)
+
+			for i := 0; i < 30; i++ {
+				if !get(client) {
+					t.Fatalf("request %d failed", i+1)
+				}
+			}
+
+			total := 0
+			for _, tp := range []*testProxy{a, b, c} {
+				total += tp.Hits()
+				if tt.even && tp.Hits() != 10 {
+					t.Errorf("proxy %s used %d times, want 10", tp.URL, tp.Hits())
+				}
+				if tp.Hits() == 0 {
+					t.Errorf("proxy %s never used", tp.URL)
+				}
+			}
+			if total != 30 {
+				t.Errorf("proxies used %d times, want 30", total)
+			}
+		})
+	}
+}
+
+func TestProxyRetire(t *testing.T) {
+	good, bad := newTestProxy(t), newTestProxy(t)
+	bad.SetBanned(true)
+
+	client, f := newProxyClient(t, nil, good, bad)
+
+	for i := 0; i < 10; i++ {
+		get(client)
+	}
+
+	// 连续被封 MaxFailures 次后停用
+	if bad.Hits() != 2 {
+		t.Errorf("banned proxy used %d times, want 2", bad.Hits())
+	}
+	if !proxyDead(f, bad) {
+		t.Error("banned proxy not retired")
+	}
+	if proxyDead(f, good) {
+		t.Error("good proxy retired")
+	}
+
+	// 所有代理都停用后返回错误
+	good.SetBanned(true)
+	for i := 0; i < 3; i++ {
+		get(client)
+	}
+	if _, err := client.Get("http://novel.invalid/book"); err == nil {
+		t.Error("expected error when all proxies are retired")
+	}
+}
+
+func TestProxyRecheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		checkURL    string
+		maxFailures int
+	}{
+		// 没有检查地址时到期直接恢复，再失败一次就停用
+		{"no check url", "", 2},
+		// max_failures 为 0 时按 1 处理
+		{"zero max failures", "", 0},
+		// 有检查地址时通过代理访问，成功后恢复
+		{"check url", "http://check.invalid/", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			tp.SetBanned(true)
+
+			client, f := newProxyClient(t, func(conf *ProxyConfig) {
+				conf.MaxFailures = tt.maxFailures
+				conf.RecheckInterval = 20 * time.Millisecond
+				conf.CheckURL = tt.checkURL
+			}, tp)
+
+			for i := 0; i < 3 && !proxyDead(f, tp); i++ {
+				get(client)
+			}
+			if !proxyDead(f, tp) {
+				t.Fatal("proxy not retired")
+			}
+
+			time.Sleep(30 * time.Millisecond)
+
+			if tt.checkURL == "" {
+				// 恢复后仍被封，失败一次就再次停用
+				if get(client) {
+					t.Fatal("banned proxy succeeded")
+				}
+				if !proxyDead(f, tp) {
+					t.Fatal("revived proxy not retired after one more failure")
+				}
+
+				time.Sleep(30 * time.Millisecond)
+				tp.SetBanned(false)
+				if !get(client) {
+					t.Fatal("proxy not revived")
+				}
+				if proxyDead(f, tp) {
+					t.Error("proxy dead after a successful request")
+				}
+				return
+			}
+
+			// 检查失败时保持停用
+			if get(client) {
+				t.Fatal("request succeeded while the only proxy is retired")
+			}
+			waitFor(t, func() bool {
+				hits := tp.Hits()
+				return hits > 0 && !proxyChecking(f)
+			})
+			if !proxyDead(f, tp) {
+				t.Fatal("proxy revived although the check failed")
+			}
+
+			tp.SetBanned(false)
+			time.Sleep(30 * time.Millisecond)
+			get(client) // 触发后台检查
+			waitFor(t, func() bool {
+				return !proxyDead(f, tp)
+			})
+
+			if !get(client) {
+				t.Error("request through the revived proxy failed")
+			}
+		})
+	}
+}
+
+func proxyChecking(f *Fetcher) bool {
+	p := f.transport.proxies
+	p.Lock()
+	defer p.Unlock()
+
+	for _, ps := range p.proxies {
+		if ps.checking {
+			return true
+		}
+	}
+	return false
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewProxyPoolMaxFailures(t *testing.T) {
+	for _, tt := range []struct{ conf, want int }{{-1, 1}, {0, 1}, {1, 1}, {3, 3}} {
+		p, err := NewProxyPool(ProxyConfig{List: []string{"127.0.0.1:1080"}, MaxFailures: tt.conf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.conf.MaxFailures != tt.want {
+			t.Errorf("max_failures %d: got %d, want %d", tt.conf, p.conf.MaxFailures, tt.want)
+		}
+	}
+}
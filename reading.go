@@ -0,0 +1,333 @@
+// 在线阅读
+package main
+
+import (
+	"github.com/ghaoo/novel/wechat"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 用户\x00书源:ID -> ReadingProgress
+var bucketReading = []byte("reading")
+
+// #阅读#书名、#阅读#、#下一章#、#上一章#、#跳转#章节序号
+var readreg = regexp.MustCompile(`#(阅读|下一章|上一章|跳转)#([^#]*)`)
+
+var numreg = regexp.MustCompile(`\d+`)
+
+// ReadingProgress 用户在一本书中的阅读位置
+type ReadingProgress struct {
+	User    string
+	Source  string
+	ID      int
+	Chapter int // 目录中的序号，从 0 开始
+	Updated time.Time
+}
+
+func readingKey(user, source string, id int) []byte {
+	return append(append([]byte(user), 0), catalogKey(source, id)...)
+}
+
+// SetProgress 保存阅读位置
+func (d *CatalogDB) SetProgress(p ReadingProgress) error {
+	data, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketReading)
+		if err != nil {
+			return err
+		}
+		return b.Put(readingKey(p.User, p.Source, p.ID), data)
+	})
+}
+
+// Progress 用户在一本书中的阅读位置
+func (d *CatalogDB) Progress(user string, cl Catalog) (ReadingProgress, bool, error) {
+	p := ReadingProgress{}
+	found := false
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketReading)
+		if b == nil {
+			return nil
+		}
+
+		data := b.Get(readingKey(user, cl.Source, cl.ID))
+		if data == nil {
+			return nil
+		}
+
+		found = true
+		return json.Unmarshal(data, &p)
+	})
+
+	return p, found, err
+}
+
+// Progresses 用户正在读的书，最近读的在前
+func (d *CatalogDB) Progresses(user string) ([]ReadingProgress, error) {
+	ps := []ReadingProgress{}
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketReading)
+		if b == nil {
+			return nil
+		}
+
+		prefix := append([]byte(user), 0)
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			p := ReadingProgress{}
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			ps = append(ps, p)
+		}
+
+		return nil
+	})
+
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Updated.After(ps[j].Updated)
+	})
+
+	return ps, err
+}
+
+// Read 处理阅读命令，进度按发送者保存，群聊中每个人各自记录
+func Read(lib *Library, bot *wechat.WeChat, msg wechat.EventMsgData) {
+	if !msg.AtMe || !readreg.MatchString(msg.Content) {
+		return
+	}
+
+	bs := readreg.FindStringSubmatch(msg.Content)
+	cmd, arg := bs[1], strings.TrimSpace(bs[2])
+
+	to := msg.FromUserName
+	user := msg.SenderUserName
+	if user == "" {
+		user = to
+	}
+
+	if cmd == "阅读" {
+		if arg == "" {
+			bot.SendTextMsg(lib.readingList(user), to)
+			return
+		}
+
+		cl, cands, err := lib.PickBook(pickUser(msg), arg)
+		if err != nil {
+			logrus.Errorf("查找【%s】失败: %v", arg, err)
+		}
+
+		if len(cands) > 0 {
+			bot.SendTextMsg(candidateList(arg, "#阅读#", cands), to)
+			return
+		}
+
+		if cl.Name == "" {
+			bot.SendTextMsg("没有找到 《"+arg+"》 这本书", to)
+			return
+		}
+
+		// 读过的书从上次的位置继续
+		p, _, err := lib.db.Progress(user, cl)
+		if err != nil {
+			logrus.Error(err)
+		}
+
+		lib.sendChapter(bot, to, user, cl, p.Chapter)
+		return
+	}
+
+	ps, err := lib.db.Progresses(user)
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	if len(ps) == 0 {
+		bot.SendTextMsg("你还没有在读的书，发送 #阅读#书名 开始阅读", to)
+		return
+	}
+
+	p := ps[0]
+	cl, err := lib.db.Get(p.Source, p.ID)
+	if err != nil {
+		logrus.Errorf("读取书籍【%s:%d】失败: %v", p.Source, p.ID, err)
+		bot.SendTextMsg("读取书籍失败，请稍后再试...", to)
+		return
+	}
+
+	idx := p.Chapter
+	switch cmd {
+	case "下一章":
+		idx++
+	case "上一章":
+		idx--
+	case "跳转":
+		n, err := strconv.Atoi(numreg.FindString(arg))
+		if err != nil {
+			bot.SendTextMsg("请发送 #跳转#章节序号，如 #跳转#12", to)
+			return
+		}
+		idx = n - 1
+	}
+
+	if idx < 0 {
+		bot.SendTextMsg("《"+cl.Name+"》已经是第一章了", to)
+		return
+	}
+
+	if idx >= len(cl.Chapters) {
+		// 读到最后时检查是否有新章节
+		lib.FetchBook(cl, false, nil)
+		bot.SendTextMsg(fmt.Sprintf("《%s》共 %d 章，已经是最新章节了，发送 #订阅#%s 在更新时收到推送", cl.Name, len(cl.Chapters), cl.Name), to)
+		return
+	}
+
+	lib.sendChapter(bot, to, user, cl, idx)
+}
+
+// sendChapter 发送第 idx 章并记录阅读位置，章节太长时分成多条消息
+func (lib *Library) sendChapter(bot *wechat.WeChat, to, user string, cl Catalog, idx int) {
+	if idx < 0 || idx >= len(cl.Chapters) {
+		idx = 0
+	}
+
+	if len(cl.Chapters) == 0 {
+		bot.SendTextMsg("《"+cl.Name+"》还没有章节", to)
+		return
+	}
+
+	cpt := cl.Chapters[idx]
+
+	data, err := ioutil.ReadFile(lib.store.ChapterFile(cl, cpt.ID))
+	if os.IsNotExist(err) {
+		// 没下载的章节先加入下载队列
+		lib.FetchBook(cl, false, nil)
+		bot.SendTextMsg(fmt.Sprintf("《%s》第 %d 章还没有下载，已开始下载，请稍后再试", cl.Name, idx+1), to)
+		return
+	} else if err != nil {
+		logrus.Errorf("读取章节【%s】失败: %v", cpt.Name, err)
+		bot.SendTextMsg("读取章节失败，请稍后再试...", to)
+		return
+	}
+
+	title, paragraphs := parseRbx(string(data))
+	if title == "" {
+		title = cpt.Name
+	}
+
+	header := fmt.Sprintf("《%s》%s（%d/%d）", cl.Name, title, idx+1, len(cl.Chapters))
+	texts := splitMessage(header, paragraphs, lib.conf.Reading.MessageSize)
+
+	if idx+1 < len(cl.Chapters) {
+		texts[len(texts)-1] += "\n\n发送 #下一章# 继续阅读"
+	}
+
+	for _, text := range texts {
+		if err := bot.SendTextMsg(text, to); err != nil {
+			logrus.Errorf("发送章节【%s】失败: %v", cpt.Name, err)
+			return
+		}
+	}
+
+	err = lib.db.SetProgress(ReadingProgress{
+		User:    user,
+		Source:  cl.Source,
+		ID:      cl.ID,
+		Chapter: idx,
+		Updated: time.Now(),
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (lib *Library) readingList(user string) string {
+	ps, err := lib.db.Progresses(user)
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	if len(ps) == 0 {
+		return "你还没有在读的书，发送 #阅读#书名 开始阅读"
+	}
+
+	lines := []string{"正在读："}
+	for _, p := range ps {
+		cl, err := lib.db.Get(p.Source, p.ID)
+		if err != nil || p.Chapter >= len(cl.Chapters) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("《%s》第 %d/%d 章 %s", cl.Name, p.Chapter+1, len(cl.Chapters), cl.Chapters[p.Chapter].Name))
+	}
+	lines = append(lines, "#下一章#、#上一章#、#跳转#序号 对第一本生效，发送 #阅读#书名 切换")
+
+	return strings.Join(lines, "\n")
+}
+
+// splitMessage 按段落拼成不超过 size 个字的消息，单段超长时按字切开，size 为 0 时不拆分；
+// 拆成多条时标题后加上页码
+func splitMessage(title string, paragraphs []string, size int) []string {
+	if size <= 0 {
+		return []string{title + "\n\n" + strings.Join(paragraphs, "\n")}
+	}
+
+	pages := []string{}
+	cur := []string{}
+	n := 0
+
+	flush := func() {
+		if len(cur) > 0 {
+			pages = append(pages, strings.Join(cur, "\n"))
+			cur, n = nil, 0
+		}
+	}
+
+	for _, para := range paragraphs {
+		rs := []rune(para)
+		for len(rs) > 0 {
+			room := size - n
+			if room <= 0 || (n > 0 && len(rs) > room) {
+				flush()
+				room = size
+			}
+
+			k := len(rs)
+			if k > room {
+				k = room
+			}
+
+			cur = append(cur, string(rs[:k]))
+			n += k + 1
+			rs = rs[k:]
+		}
+	}
+	flush()
+
+	if len(pages) <= 1 {
+		return []string{title + "\n\n" + strings.Join(pages, "")}
+	}
+
+	texts := make([]string, len(pages))
+	for i, page := range pages {
+		texts[i] = fmt.Sprintf("%s [%d/%d]\n\n%s", title, i+1, len(pages), page)
+	}
+
+	return texts
+}
@@ -0,0 +1,322 @@
+// 站点规则
+package main
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding/htmlindex"
+	"gopkg.in/yaml.v2"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SiteRule 站点规则，描述一个小说站点的链接格式、页面选择器和编码
+type SiteRule struct {
+	Name     string   `json:"name" yaml:"name"`         // 书源名称
+	Domains  []string `json:"domains" yaml:"domains"`   // 允许抓取的域名
+	Encoding string   `json:"encoding" yaml:"encoding"` // 页面默认编码，如 gbk、big5，响应中没有声明编码时使用，为空时自动识别
+
+	BookURL        string `json:"book_url" yaml:"book_url"`               // 目录页链接模板，{id} 为书籍 ID，{sub} 为 ID/1000
+	BookPattern    string `json:"book_pattern" yaml:"book_pattern"`       // 目录页链接正则，需包含命名分组 id
+	ChapterPattern string `json:"chapter_pattern" yaml:"chapter_pattern"` // 章节页链接正则，需包含命名分组 id
+
+	IDs struct {
+		From int `json:"from" yaml:"from"`
+		To   int `json:"to" yaml:"to"`
+	} `json:"ids" yaml:"ids"` // 全站抓取时的 ID 范围
+
+	Catalog struct {
+		Root        string `json:"root" yaml:"root"`
+		Name        string `json:"name" yaml:"name"`
+		Author      string `json:"author" yaml:"author"`
+		Category    string `json:"category" yaml:"category"`
+		LastUpdate  string `json:"last_update" yaml:"last_update"`
+		LastChapter string `json:"last_chapter" yaml:"last_chapter"`
+		Chapters    string `json:"chapters" yaml:"chapters"`   // 章节链接 a 标签
+		NotFound    string `json:"not_found" yaml:"not_found"` // 书籍不存在时页面中的提示文字
+	} `json:"catalog" yaml:"catalog"`
+
+	Chapter struct {
+		Root    string            `json:"root" yaml:"root"`
+		Book    string            `json:"book" yaml:"book"`
+		Title   string            `json:"title" yaml:"title"`
+		Content string            `json:"content" yaml:"content"`
+		Strip   []string          `json:"strip" yaml:"strip"`     // 正文中需要删除的元素
+		Replace map[string]string `json:"replace" yaml:"replace"` // 正文文字替换，一次替换完，较长的文字优先
+	} `json:"chapter" yaml:"chapter"`
+}
+
+// ruleSource 由站点规则驱动的书源
+type ruleSource struct {
+	rule       SiteRule
+	bookReg    *regexp.Regexp
+	chapterReg *regexp.Regexp
+	replacer   *strings.Replacer
+}
+
+// LoadRules 加载目录下所有 .json/.yml/.yaml 规则文件并注册为书源
+func LoadRules(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+
+		fname := filepath.Join(dir, fi.Name())
+
+		switch strings.ToLower(filepath.Ext(fname)) {
+		case ".json", ".yml", ".yaml":
+		default:
+			continue
+		}
+
+		src, err := LoadRule(fname)
+		if err != nil {
+			return err
+		}
+
+		if _, err := SourceByName(src.Name()); err == nil {
+			logrus.Warnf("站点规则【%s】替换同名书源: %s", src.Name(), fname)
+		}
+
+		RegisterSource(src)
+
+		logrus.Infof("加载站点规则【%s】: %s", src.Name(), fname)
+	}
+
+	return nil
+}
+
+// LoadRule 读取单个规则文件
+func LoadRule(fname string) (BookSource, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := SiteRule{}
+
+	if strings.ToLower(filepath.Ext(fname)) == ".json" {
+		err = json.Unmarshal(data, &rule)
+	} else {
+		err = yaml.Unmarshal(data, &rule)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("parse rule %s failed: %v", fname, err)
+	}
+
+	return NewRuleSource(rule)
+}
+
+// NewRuleSource 根据站点规则创建书源
+func NewRuleSource(rule SiteRule) (BookSource, error) {
+	if rule.Name == "" {
+		return nil, fmt.Errorf("rule name is required")
+	}
+
+	if len(rule.Domains) == 0 {
+		return nil, fmt.Errorf("rule [%s]: domains is required", rule.Name)
+	}
+
+	if rule.Catalog.Root == "" || rule.Chapter.Root == "" {
+		return nil, fmt.Errorf("rule [%s]: catalog.root and chapter.root are required", rule.Name)
+	}
+
+	bookReg, err := compileIDPattern(rule.BookPattern)
+	if err != nil {
+		return nil, fmt.Errorf("rule [%s]: book_pattern %v", rule.Name, err)
+	}
+
+	chapterReg, err := compileIDPattern(rule.ChapterPattern)
+	if err != nil {
+		return nil, fmt.Errorf("rule [%s]: chapter_pattern %v", rule.Name, err)
+	}
+
+	if rule.Encoding != "" {
+		if _, err := htmlindex.Get(rule.Encoding); err != nil {
+			return nil, fmt.Errorf("rule [%s]: unknown encoding %s", rule.Name, rule.Encoding)
+		}
+	}
+
+	return &ruleSource{
+		rule:       rule,
+		bookReg:    bookReg,
+		chapterReg: chapterReg,
+		replacer:   newReplacer(rule.Chapter.Replace),
+	}, nil
+}
+
+// newReplacer 按固定顺序替换，map 的遍历顺序是随机的，互相包含的文字会得到不同的结果。
+// 较长的文字排在前面，同一位置优先匹配较长的文字
+func newReplacer(replace map[string]string) *strings.Replacer {
+	keys := make([]string, 0, len(replace))
+	for from := range replace {
+		if from != "" {
+			keys = append(keys, from)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+
+	pairs := make([]string, 0, len(keys)*2)
+	for _, from := range keys {
+		pairs = append(pairs, from, replace[from])
+	}
+
+	return strings.NewReplacer(pairs...)
+}
+
+func compileIDPattern(pattern string) (*regexp.Regexp, error) {
+	reg, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if reg.SubexpIndex("id") < 0 {
+		return nil, fmt.Errorf("%s has no (?P<id>) group", pattern)
+	}
+
+	return reg, nil
+}
+
+func (s *ruleSource) Name() string {
+	return s.rule.Name
+}
+
+func (s *ruleSource) Domains() []string {
+	return s.rule.Domains
+}
+
+func (s *ruleSource) Match(url string) bool {
+	return s.bookReg.MatchString(url) || s.chapterReg.MatchString(url)
+}
+
+func (s *ruleSource) BookURL(id int) string {
+	return strings.NewReplacer(
+		"{id}", strconv.Itoa(id),
+		"{sub}", strconv.Itoa(id/1000),
+	).Replace(s.rule.BookURL)
+}
+
+func (s *ruleSource) IDs() []int {
+	return idRange(s.rule.IDs.From, s.rule.IDs.To)
+}
+
+func (s *ruleSource) Encoding() string {
+	return s.rule.Encoding
+}
+
+func (s *ruleSource) CatalogSelector() string {
+	return s.rule.Catalog.Root
+}
+
+func (s *ruleSource) ParseCatalog(url string, dom *goquery.Selection) (Catalog, error) {
+	cl := Catalog{}
+	sel := s.rule.Catalog
+
+	id, err := submatchID(s.bookReg, url)
+	if err != nil {
+		return cl, err
+	}
+
+	if sel.NotFound != "" && strings.Contains(dom.Text(), sel.NotFound) {
+		return cl, fmt.Errorf("%s: %w", url, ErrNoBook)
+	}
+
+	cpts := []Chapter{}
+	dom.Find(sel.Chapters).Each(func(i int, a *goquery.Selection) {
+		curl, _ := a.Attr("href")
+		curl = absoluteURL(url, curl)
+
+		if cid, err := submatchID(s.chapterReg, curl); err == nil {
+			cpts = append(cpts, Chapter{
+				ID:   cid,
+				Name: cleanText(a.Text()),
+				Url:  curl,
+			})
+		}
+	})
+
+	cl.ID = id
+	cl.SubID = strconv.Itoa(id / 1000)
+	cl.Source = s.rule.Name
+	cl.Name = cleanText(findText(dom, sel.Name))
+	cl.Author = findText(dom, sel.Author)
+	cl.Url = url
+	cl.Category = findText(dom, sel.Category)
+	cl.Chapters = cpts
+	cl.LastChapter = findText(dom, sel.LastChapter)
+	cl.LastUpdate = findText(dom, sel.LastUpdate)
+
+	if cl.Name == "" {
+		return cl, fmt.Errorf("rule [%s]: no book name found in %s", s.rule.Name, url)
+	}
+
+	return cl, nil
+}
+
+func (s *ruleSource) ChapterSelector() string {
+	return s.rule.Chapter.Root
+}
+
+func (s *ruleSource) ParseChapter(url string, dom *goquery.Selection) (Content, error) {
+	ct := Content{}
+	sel := s.rule.Chapter
+
+	id, err := submatchID(s.chapterReg, url)
+	if err != nil {
+		return ct, err
+	}
+
+	content := dom.Find(sel.Content)
+	for _, strip := range sel.Strip {
+		content.Find(strip).Remove()
+	}
+
+	article, _ := content.Html()
+	article = s.replacer.Replace(article)
+	article = strings.Replace(article, "<br/>", "\n", -1)
+
+	ct.Book = findText(dom, sel.Book)
+	ct.Chapter = Chapter{ID: id, Url: url, Name: findText(dom, sel.Title)}
+	ct.Text = article
+
+	return ct, nil
+}
+
+func submatchID(reg *regexp.Regexp, url string) (int, error) {
+	m := reg.FindStringSubmatch(url)
+	if m == nil {
+		return 0, fmt.Errorf("url [%s] not match %s", url, reg)
+	}
+
+	return strconv.Atoi(m[reg.SubexpIndex("id")])
+}
+
+func findText(dom *goquery.Selection, selector string) string {
+	if selector == "" {
+		return ""
+	}
+
+	return strings.TrimSpace(dom.Find(selector).First().Text())
+}
@@ -0,0 +1,32 @@
+// 站点规则测试
+package main
+
+import "testing"
+
+func TestNewReplacer(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace map[string]string
+		in      string
+		want    string
+	}{
+		{"empty", nil, "聽聽正文", "聽聽正文"},
+		{"single", map[string]string{"聽": " "}, "聽聽正文", "  正文"},
+		// 较长的文字优先
+		{"overlap", map[string]string{"聽": " ", "聽聽聽聽": "　　"}, "聽聽聽聽正文聽", "　　正文 "},
+		// 只替换一次，替换结果不会再被替换
+		{"no chain", map[string]string{"a": "b", "b": "c"}, "ab", "bc"},
+		{"same length", map[string]string{"ab": "1", "bc": "2"}, "abc", "1c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// map 顺序随机，多次创建结果应相同
+			for i := 0; i < 20; i++ {
+				if got := newReplacer(tt.replace).Replace(tt.in); got != tt.want {
+					t.Fatalf("Replace(%q) = %q, want %q", tt.in, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+// 书籍搜索
+package main
+
+import (
+	"github.com/ghaoo/novel/wechat"
+	"github.com/mozillazg/go-pinyin"
+	"github.com/patrickmn/go-cache"
+
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// 候选列表的保留时间
+const pickExpiration = 5 * time.Minute
+
+var picks = cache.New(pickExpiration, time.Minute)
+
+// SearchIndex 内存中的书名、作者、分类索引，支持拼音、首字母和模糊匹配
+type SearchIndex struct {
+	sync.RWMutex
+	entries map[string]searchEntry
+}
+
+type searchEntry struct {
+	source string
+	id     int
+
+	name, namePinyin, nameInitials       string
+	author, authorPinyin, authorInitials string
+	category                             string
+}
+
+type searchHit struct {
+	entry searchEntry
+	score int
+}
+
+// NewSearchIndex 创建空索引
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{entries: make(map[string]searchEntry)}
+}
+
+// Build 从数据库建立索引
+func (idx *SearchIndex) Build(d *CatalogDB) error {
+	return d.Each(func(cl Catalog) error {
+		idx.Add(cl)
+		return nil
+	})
+}
+
+// Add 新增或更新索引
+func (idx *SearchIndex) Add(cl Catalog) {
+	e := searchEntry{
+		source:   cl.Source,
+		id:       cl.ID,
+		name:     foldText(cl.Name),
+		author:   foldText(cl.Author),
+		category: foldText(cl.Category),
+	}
+	e.namePinyin, e.nameInitials = pinyinOf(cl.Name)
+	e.authorPinyin, e.authorInitials = pinyinOf(cl.Author)
+
+	idx.Lock()
+	idx.entries[string(catalogKey(cl.Source, cl.ID))] = e
+	idx.Unlock()
+}
+
+// Len 索引中的书籍数量
+func (idx *SearchIndex) Len() int {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	return len(idx.entries)
+}
+
+// Search 按空格分词，每个词都要匹配书名、作者或分类之一，按得分排序
+func (idx *SearchIndex) Search(query string, limit int) []searchHit {
+	tokens := []string{}
+	for _, t := range strings.Fields(query) {
+		if t = foldText(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	idx.RLock()
+	hits := []searchHit{}
+	for _, e := range idx.entries {
+		score := 0
+		for _, t := range tokens {
+			s := e.match(t)
+			if s == 0 {
+				score = 0
+				break
+			}
+			score += s
+		}
+		if score > 0 {
+			hits = append(hits, searchHit{e, score})
+		}
+	}
+	idx.RUnlock()
+
+	sort.Slice(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if len(a.entry.name) != len(b.entry.name) {
+			return len(a.entry.name) < len(b.entry.name)
+		}
+		if a.entry.source != b.entry.source {
+			return a.entry.source < b.entry.source
+		}
+		return a.entry.id < b.entry.id
+	})
+
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	return hits
+}
+
+// match 单个词的得分，书名权重最高，其次拼音、作者、分类
+func (e searchEntry) match(t string) int {
+	best := 0
+	for _, f := range []struct {
+		text   string
+		weight int
+	}{
+		{e.name, 10},
+		{e.namePinyin, 8},
+		{e.nameInitials, 7},
+		{e.author, 7},
+		{e.authorPinyin, 6},
+		{e.authorInitials, 5},
+		{e.category, 3},
+	} {
+		if s := matchText(t, f.text) * f.weight; s > best {
+			best = s
+		}
+	}
+
+	return best
+}
+
+// matchText 完全匹配 > 前缀 > 包含 > 按顺序包含所有字符
+func matchText(t, text string) int {
+	switch {
+	case text == "":
+		return 0
+	case text == t:
+		return 100
+	case strings.HasPrefix(text, t):
+		return 80
+	case strings.Contains(text, t):
+		return 60
+	case len([]rune(t)) > 1 && isSubsequence(t, text):
+		return 20
+	}
+	return 0
+}
+
+func isSubsequence(t, text string) bool {
+	rs := []rune(t)
+	i := 0
+	for _, r := range text {
+		if i < len(rs) && rs[i] == r {
+			i++
+		}
+	}
+	return i == len(rs)
+}
+
+// foldText 转小写，去掉空白和标点
+func foldText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+var pinyinArgs = func() pinyin.Args {
+	a := pinyin.NewArgs()
+	a.Fallback = func(r rune, a pinyin.Args) []string {
+		return []string{string(r)}
+	}
+	return a
+}()
+
+// pinyinOf 全拼和首字母，非汉字原样保留
+func pinyinOf(s string) (string, string) {
+	full, initials := "", ""
+	for _, p := range pinyin.LazyPinyin(foldText(s), pinyinArgs) {
+		if p == "" {
+			continue
+		}
+		full += p
+		initials += string([]rune(p)[0])
+	}
+	return full, initials
+}
+
+// Search 搜索书籍，先按原关键词搜索，没有结果时再按繁体转简体后的关键词搜索。
+// 词典会把著、於等简体字也转换掉，所以不能直接转换后再搜索
+func (lib *Library) Search(query string, limit int) []Catalog {
+	cls, _ := lib.SearchPage(query, 0, limit)
+	return cls
+}
+
+// SearchPage 分页搜索，返回一页书籍和匹配总数，只读取当前页的书籍
+func (lib *Library) SearchPage(query string, offset, limit int) ([]Catalog, int) {
+	hits := lib.index.Search(query, 0)
+	if len(hits) == 0 {
+		if q := T2S().Convert(query); q != query {
+			hits = lib.index.Search(q, 0)
+		}
+	}
+
+	total := len(hits)
+	if offset > total {
+		offset = total
+	}
+	hits = hits[offset:]
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	cls := []Catalog{}
+	for _, hit := range hits {
+		if cl, err := lib.db.Get(hit.entry.source, hit.entry.id); err == nil {
+			cls = append(cls, cl)
+		}
+	}
+
+	return cls, total
+}
+
+// pickUser 候选列表按群和发言人区分，群里每个人回复的序号只对应自己的候选列表
+func pickUser(msg wechat.EventMsgData) string {
+	return msg.FromUserName + "\x00" + msg.SenderUserName
+}
+
+// PickBook 确定用户要找的书：用户有未过期的候选列表时数字为列表中的序号，书名唯一时直接返回，
+// 同名书或模糊匹配时返回候选列表并记住，等待用户回复序号。user 为空时不记住候选列表
+func (lib *Library) PickBook(user, query string) (Catalog, []Catalog, error) {
+	query = strings.TrimSpace(query)
+
+	// 没有候选列表或序号超出范围时按书名查找，书名可以是数字
+	if n, err := strconv.Atoi(query); err == nil && user != "" {
+		if v, ok := picks.Get(user); ok {
+			cands := v.([]Catalog)
+			if n >= 1 && n <= len(cands) {
+				picks.Delete(user)
+				return cands[n-1], nil, nil
+			}
+		}
+	}
+
+	cls, err := lib.FindBook(query)
+	if err != nil {
+		return Catalog{}, nil, err
+	}
+
+	if len(cls) == 1 {
+		return cls[0], nil, nil
+	}
+
+	// 繁体书名
+	if len(cls) == 0 {
+		if q := T2S().Convert(query); q != query {
+			if cls, err = lib.FindBook(q); err != nil {
+				return Catalog{}, nil, err
+			}
+			if len(cls) == 1 {
+				return cls[0], nil, nil
+			}
+		}
+	}
+
+	if len(cls) == 0 {
+		cls = lib.Search(query, 10)
+	}
+
+	if len(cls) > 0 && user != "" {
+		picks.Set(user, cls, pickExpiration)
+	}
+
+	return Catalog{}, cls, nil
+}
+
+// candidateList 候选列表消息，prefix 为回复序号时使用的命令前缀
+func candidateList(query, prefix string, cls []Catalog) string {
+	lines := []string{fmt.Sprintf("找到 %d 本和「%s」相关的书，请回复 %s序号# 选择：", len(cls), query, prefix)}
+
+	for i, cl := range cls {
+		line := fmt.Sprintf("%d. 《%s》 %s", i+1, cl.Name, cl.Author)
+		if cl.Category != "" {
+			line += " / " + cl.Category
+		}
+		if cl.LastChapter != "" {
+			line += " / " + cl.LastChapter
+		}
+		lines = append(lines, line+" ("+cl.Source+")")
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,174 @@
+// 书源
+package main
+
+import (
+	"github.com/PuerkitoBio/goquery"
+
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strings"
+	"sync"
+)
+
+// BookSource 书源，负责一个小说站点的链接解析、目录解析和章节解析
+type BookSource interface {
+	// Name 书源名称，保存在 Catalog.Source 中
+	Name() string
+
+	// Domains 允许抓取的域名
+	Domains() []string
+
+	// Match 判断链接是否属于该书源
+	Match(url string) bool
+
+	// BookURL 根据书籍 ID 生成目录页链接
+	BookURL(id int) string
+
+	// IDs 全站书籍 ID 列表，按抓取顺序排列
+	IDs() []int
+
+	// Encoding 页面默认编码，如 gbk，响应头、<meta charset> 都没有声明编码时使用，为空时自动识别
+	Encoding() string
+
+	// CatalogSelector 目录页根节点选择器
+	CatalogSelector() string
+
+	// ParseCatalog 解析目录页，页面明确说明书籍不存在时返回 ErrNoBook
+	ParseCatalog(url string, dom *goquery.Selection) (Catalog, error)
+
+	// ChapterSelector 章节页根节点选择器
+	ChapterSelector() string
+
+	// ParseChapter 解析章节页
+	ParseChapter(url string, dom *goquery.Selection) (Content, error)
+}
+
+// ErrNoBook 书籍不存在，全站抓取时不再重试
+var ErrNoBook = errors.New("no such book")
+
+// Content 章节内容
+type Content struct {
+	Book    string
+	Chapter Chapter
+	Text    string
+}
+
+var sources = struct {
+	sync.RWMutex
+	list []BookSource
+}{}
+
+// RegisterSource 注册书源，先注册的书源为默认书源
+func RegisterSource(src BookSource) {
+	sources.Lock()
+	defer sources.Unlock()
+
+	for i, s := range sources.list {
+		if s.Name() == src.Name() {
+			sources.list[i] = src
+			return
+		}
+	}
+
+	sources.list = append(sources.list, src)
+}
+
+// Sources 已注册的书源
+func Sources() []BookSource {
+	sources.RLock()
+	defer sources.RUnlock()
+
+	return append([]BookSource{}, sources.list...)
+}
+
+// SourceByName 根据名称查找书源
+func SourceByName(name string) (BookSource, error) {
+	sources.RLock()
+	defer sources.RUnlock()
+
+	for _, s := range sources.list {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown book source [%s]", name)
+}
+
+// SourceByURL 根据链接查找书源
+func SourceByURL(url string) (BookSource, error) {
+	sources.RLock()
+	defer sources.RUnlock()
+
+	for _, s := range sources.list {
+		if s.Match(url) {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no book source for [%s]", url)
+}
+
+// SourceOf 查找书籍记录所属书源，旧记录没有 Source 字段时按链接查找，最后使用默认书源
+func SourceOf(cl Catalog) (BookSource, error) {
+	if cl.Source != "" {
+		return SourceByName(cl.Source)
+	}
+
+	if cl.Url != "" {
+		if src, err := SourceByURL(cl.Url); err == nil {
+			return src, nil
+		}
+	}
+
+	return DefaultSource()
+}
+
+// DefaultSource 默认书源
+func DefaultSource() (BookSource, error) {
+	sources.RLock()
+	defer sources.RUnlock()
+
+	if len(sources.list) == 0 {
+		return nil, fmt.Errorf("no book source registered")
+	}
+
+	return sources.list[0], nil
+}
+
+// cleanText 去掉标题中的转义符和首尾空白
+func cleanText(s string) string {
+	return strings.TrimSpace(strings.Replace(s, `\`, "", -1))
+}
+
+// absoluteURL 将页面中的相对链接转换为绝对链接
+func absoluteURL(base, href string) string {
+	u, err := neturl.Parse(base)
+	if err != nil {
+		return href
+	}
+
+	ref, err := u.Parse(href)
+	if err != nil {
+		return href
+	}
+
+	return ref.String()
+}
+
+// idRange 生成 from 到 to 的 ID 列表，from 大于 to 时倒序
+func idRange(from, to int) []int {
+	ids := []int{}
+	if from >= to {
+		for i := from; i >= to; i-- {
+			ids = append(ids, i)
+		}
+	} else {
+		for i := from; i <= to; i++ {
+			ids = append(ids, i)
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,142 @@
+// 分卷和压缩
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SplitTxt 按章节把合并后的 txt 切成多卷写入 dir，文件名为 <书名>-01.txt、<书名>-02.txt…，每卷开头保留书名
+// 每卷不超过 maxSize 字节和 maxChapters 章（为 0 时不限），单章超过 maxSize 时单独成卷。
+// 同一本书可能同时发送给多个人，dir 应为这次发送独有的目录
+func SplitTxt(txtpath, dir string, maxSize int, maxChapters int) ([]string, error) {
+	data, err := ioutil.ReadFile(txtpath)
+	if err != nil {
+		return nil, err
+	}
+
+	header, chapters := splitChapters(data)
+
+	base := strings.TrimSuffix(filepath.Base(txtpath), filepath.Ext(txtpath))
+
+	vols := [][]byte{}
+	cur := new(bytes.Buffer)
+	n := 0
+
+	for _, cpt := range chapters {
+		full := (maxSize > 0 && len(header)+cur.Len()+len(cpt) > maxSize) || (maxChapters > 0 && n >= maxChapters)
+		if n > 0 && full {
+			vols = append(vols, cur.Bytes())
+			cur, n = new(bytes.Buffer), 0
+		}
+
+		cur.Write(cpt)
+		n++
+	}
+
+	if n > 0 {
+		vols = append(vols, cur.Bytes())
+	}
+
+	width := len(fmt.Sprint(len(vols)))
+	if width < 2 {
+		width = 2
+	}
+
+	files := []string{}
+	for i, vol := range vols {
+		fname := filepath.Join(dir, fmt.Sprintf("%s-%0*d.txt", base, width, i+1))
+
+		content := append(append([]byte{}, header...), vol...)
+		if err = write(fname, content); err != nil {
+			return nil, err
+		}
+
+		files = append(files, fname)
+	}
+
+	return files, nil
+}
+
+// splitChapters 以 "### " 开头的行为章节起点，返回书名部分和每一章
+func splitChapters(data []byte) ([]byte, [][]byte) {
+	header := []byte{}
+	chapters := [][]byte{}
+
+	cur := (*bytes.Buffer)(nil)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), len(data)+1)
+
+	for sc.Scan() {
+		line := sc.Bytes()
+
+		if bytes.HasPrefix(line, []byte("### ")) {
+			if cur != nil {
+				chapters = append(chapters, cur.Bytes())
+			}
+			cur = new(bytes.Buffer)
+		}
+
+		if cur == nil {
+			header = append(append(header, line...), '\n')
+			continue
+		}
+
+		cur.Write(line)
+		cur.WriteByte('\n')
+	}
+
+	if cur != nil {
+		chapters = append(chapters, cur.Bytes())
+	}
+
+	return header, chapters
+}
+
+// ZipFile 把文件压缩为 dir 下的同名 .zip，dir 应为这次发送独有的目录
+func ZipFile(fname, dir string) (string, error) {
+	base := filepath.Base(fname)
+	out := filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base))+".zip")
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return "", err
+	}
+	hdr.Method = zip.Deflate
+
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = io.Copy(w, f); err != nil {
+		return "", err
+	}
+
+	if err = zw.Close(); err != nil {
+		return "", err
+	}
+
+	return out, write(out, buf.Bytes())
+}
@@ -0,0 +1,205 @@
+// 书库存储
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Storage 书库目录，每本书一个子目录，按书源和 ID 区分同名书：
+//
+//	<root>/<书源>/<ID>/<章节ID>.rbx 章节
+//	<root>/<书源>/<ID>/<书名>.txt   合并后的小说
+//
+// 旧版按书名建目录 <root>/<书名>/，其中的 data.json 仅用于导入 CatalogDB，见 MigrateBookDirs
+type Storage struct {
+	root string
+}
+
+// NewStorage 创建书库
+func NewStorage(root string) *Storage {
+	return &Storage{root: filepath.Clean(root)}
+}
+
+// Root 书库根目录
+func (s *Storage) Root() string {
+	return s.root
+}
+
+// BookDir 书籍目录
+func (s *Storage) BookDir(cl Catalog) string {
+	return filepath.Join(s.root, SafeName(cl.Source), strconv.Itoa(cl.ID))
+}
+
+// ChapterFile 章节文件
+func (s *Storage) ChapterFile(cl Catalog, id int) string {
+	return filepath.Join(s.BookDir(cl), strconv.Itoa(id)+".rbx")
+}
+
+// BookFile 合并后的小说文件，ext 为扩展名，如 .txt、.epub
+func (s *Storage) BookFile(cl Catalog, ext string) string {
+	return filepath.Join(s.BookDir(cl), SafeName(cl.Name)+ext)
+}
+
+// Exists 书籍目录是否存在
+func (s *Storage) Exists(cl Catalog) bool {
+	fi, err := os.Stat(s.BookDir(cl))
+	return err == nil && fi.IsDir()
+}
+
+// Books 书库中所有书籍的书源和 ID
+func (s *Storage) Books() map[string][]int {
+	books := make(map[string][]int)
+
+	srcs, _ := ioutil.ReadDir(s.root)
+	for _, src := range srcs {
+		if !src.IsDir() {
+			continue
+		}
+
+		dirs, _ := ioutil.ReadDir(filepath.Join(s.root, src.Name()))
+		for _, fi := range dirs {
+			if id, err := strconv.Atoi(fi.Name()); err == nil && fi.IsDir() {
+				books[src.Name()] = append(books[src.Name()], id)
+			}
+		}
+	}
+
+	return books
+}
+
+// legacyDirs 旧版按书名建的书籍目录，包含章节或 data.json 的才算
+func (s *Storage) legacyDirs() []string {
+	files, _ := ioutil.ReadDir(s.root)
+
+	dirs := []string{}
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(s.root, fi.Name())
+		rbx, _ := filepath.Glob(filepath.Join(dir, "*.rbx"))
+		if _, err := os.Stat(filepath.Join(dir, "data.json")); err == nil || len(rbx) > 0 {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// Catalogs 读取旧版书籍目录中的 data.json，损坏的 data.json 会被删除
+func (s *Storage) Catalogs() []Catalog {
+	cls := []Catalog{}
+	for _, dir := range s.legacyDirs() {
+		if cl := read(filepath.Join(dir, "data.json")); cl.Name != "" {
+			cls = append(cls, cl)
+		}
+	}
+
+	return cls
+}
+
+// Chapters 已下载的章节 ID
+func (s *Storage) Chapters(cl Catalog) []int {
+	files, _ := filepath.Glob(filepath.Join(s.BookDir(cl), "*.rbx"))
+
+	ids := []int{}
+	for _, fi := range files {
+		if id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(fi), ".rbx")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// WriteChapter 保存章节
+func (s *Storage) WriteChapter(cl Catalog, id int, content []byte) error {
+	return write(s.ChapterFile(cl, id), content)
+}
+
+// SafeName 将书名转换为可以在 Windows 和 Linux 上使用的文件名
+func SafeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return -1
+		}
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+
+	// Windows 不允许以空格或点结尾
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+
+	return name
+}
+
+func read(datafile string) (cl Catalog) {
+
+	data, err := ioutil.ReadFile(datafile)
+	if err != nil {
+		os.Remove(datafile)
+		//logrus.Errorf("读取文件【%s】失败: %v", datafile, err)
+		return
+	}
+
+	err = json.Unmarshal(data, &cl)
+	if err != nil {
+		os.Remove(datafile)
+		//logrus.Errorf("解析文件【%s】失败: %v", datafile, err)
+		return
+	}
+
+	return
+}
+
+func write(file string, content []byte) error {
+
+	fpath := filepath.Clean(file)
+
+	// 检测文件夹是否存在   若不存在  创建文件夹
+	if err := ensureDir(fpath); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(content)
+
+	return err
+}
+
+// ensureDir 创建文件所在的目录
+func ensureDir(file string) error {
+	basepath := filepath.Dir(file)
+
+	if _, err := os.Stat(basepath); err != nil {
+
+		if os.IsNotExist(err) {
+			return os.MkdirAll(basepath, os.ModePerm)
+		}
+
+		return err
+	}
+
+	return nil
+}
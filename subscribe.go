@@ -0,0 +1,322 @@
+// 订阅推送
+package main
+
+import (
+	"github.com/ghaoo/novel/wechat"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 书源:ID\x00用户 -> 订阅时间和最后推送的章节
+var bucketSubscriptions = []byte("subscriptions")
+
+var subreg = regexp.MustCompile(`#(订阅|退订)#([^#]*)`)
+
+// Subscription 一条订阅
+type Subscription struct {
+	User    string `json:"-"`
+	Source  string `json:"-"`
+	ID      int    `json:"-"`
+	Created time.Time
+	Pushed  int // 最后推送的章节 ID，0 表示还没有记录
+}
+
+func subscriptionKey(source string, id int, user string) []byte {
+	return append(append(catalogKey(source, id), 0), user...)
+}
+
+func (d *CatalogDB) subscriptions(tx *bolt.Tx) (*bolt.Bucket, error) {
+	if tx.Writable() {
+		return tx.CreateBucketIfNotExists(bucketSubscriptions)
+	}
+	return tx.Bucket(bucketSubscriptions), nil
+}
+
+// Subscribe 订阅书籍
+func (d *CatalogDB) Subscribe(user string, cl Catalog) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := d.subscriptions(tx)
+		if err != nil {
+			return err
+		}
+
+		key := subscriptionKey(cl.Source, cl.ID, user)
+		if b.Get(key) != nil {
+			return nil
+		}
+
+		sub := Subscription{Created: time.Now(), Pushed: lastChapterID(cl)}
+
+		return putSubscription(b, key, sub)
+	})
+}
+
+// SetPushed 记录已推送到的章节
+func (d *CatalogDB) SetPushed(sub Subscription, id int) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := d.subscriptions(tx)
+		if err != nil {
+			return err
+		}
+
+		// 推送期间已退订
+		key := subscriptionKey(sub.Source, sub.ID, sub.User)
+		if b.Get(key) == nil {
+			return nil
+		}
+
+		sub.Pushed = id
+
+		return putSubscription(b, key, sub)
+	})
+}
+
+func putSubscription(b *bolt.Bucket, key []byte, sub Subscription) error {
+	data, err := json.Marshal(&sub)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// Unsubscribe 取消订阅
+func (d *CatalogDB) Unsubscribe(user string, cl Catalog) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := d.subscriptions(tx)
+		if err != nil {
+			return err
+		}
+		return b.Delete(subscriptionKey(cl.Source, cl.ID, user))
+	})
+}
+
+// Subscriptions 所有订阅，user 不为空时只返回该用户的订阅
+func (d *CatalogDB) Subscriptions(user string) ([]Subscription, error) {
+	subs := []Subscription{}
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b, _ := d.subscriptions(tx)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			parts := strings.SplitN(string(k), "\x00", 2)
+			if len(parts) != 2 || (user != "" && parts[1] != user) {
+				return nil
+			}
+
+			sub := Subscription{User: parts[1]}
+
+			i := strings.LastIndex(parts[0], ":")
+			if i < 0 {
+				return nil
+			}
+			sub.Source = parts[0][:i]
+			if _, err := fmt.Sscanf(parts[0][i+1:], "%d", &sub.ID); err != nil {
+				return nil
+			}
+			// 旧版本只保存了订阅时间
+			if err := json.Unmarshal(v, &sub); err != nil {
+				sub.Created, _ = time.Parse(time.RFC3339, string(v))
+			}
+
+			subs = append(subs, sub)
+			return nil
+		})
+	})
+
+	return subs, err
+}
+
+// Subscribe 处理 #订阅#书名 和 #退订#书名，书名为空时列出已订阅的书籍
+func Subscribe(lib *Library, bot *wechat.WeChat, msg wechat.EventMsgData) {
+	if !msg.AtMe || !subreg.MatchString(msg.Content) {
+		return
+	}
+
+	bs := subreg.FindStringSubmatch(msg.Content)
+	cmd, book := bs[1], strings.TrimSpace(bs[2])
+	user := msg.FromUserName
+
+	if book == "" {
+		bot.SendTextMsg(lib.subscriptionList(user), user)
+		return
+	}
+
+	cl, cands, err := lib.PickBook(pickUser(msg), book)
+	if err != nil {
+		logrus.Errorf("查找【%s】失败: %v", book, err)
+	}
+
+	if len(cands) > 0 {
+		bot.SendTextMsg(candidateList(book, "#"+cmd+"#", cands), user)
+		return
+	}
+
+	if cl.Name == "" {
+		bot.SendTextMsg("没有找到 《"+book+"》 这本书", user)
+		return
+	}
+
+	if cmd == "退订" {
+		if err = lib.db.Unsubscribe(user, cl); err != nil {
+			logrus.Error(err)
+			bot.SendTextMsg("退订失败，请稍后再试...", user)
+			return
+		}
+		bot.SendTextMsg("已退订 《"+cl.Name+"》", user)
+		return
+	}
+
+	if err = lib.db.Subscribe(user, cl); err != nil {
+		logrus.Error(err)
+		bot.SendTextMsg("订阅失败，请稍后再试...", user)
+		return
+	}
+
+	bot.SendTextMsg(fmt.Sprintf("已订阅 《%s》，最新章节：%s，有更新时会推送给你", cl.Name, cl.LastChapter), user)
+}
+
+func (lib *Library) subscriptionList(user string) string {
+	subs, err := lib.db.Subscriptions(user)
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	if len(subs) == 0 {
+		return "你还没有订阅任何书籍，发送 #订阅#书名 订阅"
+	}
+
+	lines := []string{"已订阅："}
+	for _, sub := range subs {
+		if cl, err := lib.db.Get(sub.Source, sub.ID); err == nil {
+			lines = append(lines, fmt.Sprintf("《%s》 %s", cl.Name, cl.LastChapter))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// PushSubscriptions 检查所有被订阅的书籍，把每个订阅者上次推送之后的章节推送给他。
+// 下载、更新、阅读等都会给目录增加章节，所以按订阅记录的章节和当前目录比较，不依赖这次更新的结果
+func (lib *Library) PushSubscriptions(bot *wechat.WeChat) {
+	subs, err := lib.db.Subscriptions("")
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	// 同一本书只更新一次
+	keys := []string{}
+	books := make(map[string][]Subscription)
+	for _, sub := range subs {
+		key := string(catalogKey(sub.Source, sub.ID))
+		if _, ok := books[key]; !ok {
+			keys = append(keys, key)
+		}
+		books[key] = append(books[key], sub)
+	}
+
+	for _, key := range keys {
+		first := books[key][0]
+
+		cl, err := lib.db.Get(first.Source, first.ID)
+		if err != nil {
+			logrus.Errorf("读取订阅书籍【%s:%d】失败: %v", first.Source, first.ID, err)
+			continue
+		}
+
+		// 通过队列更新，避免和用户的下载请求同时下载同一本书；
+		// 更新失败时仍推送其他途径下载的章节
+		if job := lib.jobs.Run(cl); job.Err == nil {
+			cl = job.Catalog
+		}
+
+		last := lastChapterID(cl)
+
+		for _, sub := range books[key] {
+			// 旧版本的订阅没有推送记录，从当前章节开始
+			if sub.Pushed == 0 {
+				if err := lib.db.SetPushed(sub, last); err != nil {
+					logrus.Error(err)
+				}
+				continue
+			}
+
+			cpts := chaptersAfter(cl.Chapters, sub.Pushed)
+			if len(cpts) == 0 {
+				continue
+			}
+
+			lib.pushUpdate(bot, sub.User, BookUpdate{Catalog: cl, New: cpts})
+
+			if err := lib.db.SetPushed(sub, last); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+// lastChapterID 目录中最后一章的 ID
+func lastChapterID(cl Catalog) int {
+	if len(cl.Chapters) == 0 {
+		return 0
+	}
+	return cl.Chapters[len(cl.Chapters)-1].ID
+}
+
+// chaptersAfter 目录中 id 之后的章节，目录中没有这一章时返回 ID 更大的章节
+func chaptersAfter(cpts []Chapter, id int) []Chapter {
+	for i, cpt := range cpts {
+		if cpt.ID == id {
+			return cpts[i+1:]
+		}
+	}
+
+	after := []Chapter{}
+	for _, cpt := range cpts {
+		if cpt.ID > id {
+			after = append(after, cpt)
+		}
+	}
+	return after
+}
+
+// pushUpdate 新章节较少时直接发送正文，否则发送摘要和整本小说
+func (lib *Library) pushUpdate(bot *wechat.WeChat, user string, up BookUpdate) {
+	cl := up.Catalog
+
+	if len(up.New) <= lib.conf.Subscribe.MaxText {
+		for _, cpt := range up.New {
+			data, err := ioutil.ReadFile(lib.store.ChapterFile(cl, cpt.ID))
+			if err != nil {
+				logrus.Errorf("读取章节【%s】失败: %v", cpt.Name, err)
+				continue
+			}
+
+			title, paragraphs := parseRbx(string(data))
+			if title == "" {
+				title = cpt.Name
+			}
+
+			for _, text := range splitMessage("《"+cl.Name+"》"+title, paragraphs, lib.conf.Reading.MessageSize) {
+				bot.SendTextMsg(text, user)
+			}
+		}
+		return
+	}
+
+	bot.SendTextMsg(fmt.Sprintf("《%s》更新了 %d 章，最新章节：%s", cl.Name, len(up.New), cl.LastChapter), user)
+
+	if err := bot.SendFile(lib.store.BookFile(cl, ".txt"), user); err != nil {
+		logrus.Errorf("推送《%s》给 %s 失败: %v", cl.Name, user, err)
+	}
+}
@@ -0,0 +1,121 @@
+// 章节更新
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// BookUpdate 一次更新的结果
+type BookUpdate struct {
+	Catalog Catalog   // 更新后的目录
+	New     []Chapter // 新增章节
+	Missing []Chapter // 重试后仍未下载的章节
+}
+
+// DiffChapters 返回 cur 中 old 没有的章节，按 ID 比较，ID 为 0 时按链接比较
+func DiffChapters(old, cur []Chapter) []Chapter {
+	exist := make(map[string]bool, len(old))
+	for _, cpt := range old {
+		exist[chapterKey(cpt)] = true
+	}
+
+	diff := []Chapter{}
+	for _, cpt := range cur {
+		if !exist[chapterKey(cpt)] {
+			diff = append(diff, cpt)
+		}
+	}
+
+	return diff
+}
+
+func chapterKey(cpt Chapter) string {
+	if cpt.ID != 0 {
+		return strconv.Itoa(cpt.ID)
+	}
+	return cpt.Url
+}
+
+// UpdateBook 重新抓取目录，只下载新增和缺失的章节，有变化时重新合并
+func (lib *Library) UpdateBook(cl Catalog) (BookUpdate, error) {
+	up := BookUpdate{Catalog: cl}
+
+	src, err := SourceOf(cl)
+	if err != nil {
+		return up, err
+	}
+
+	ncl := lib.CatalogFrom(src, src.BookURL(cl.ID))
+	if ncl.Name == "" {
+		return up, fmt.Errorf("refresh catalog of 《%s》 failed", cl.Name)
+	}
+
+	ncl.CheckedAt = time.Now()
+	if err = lib.db.Put(ncl); err != nil {
+		return up, err
+	}
+
+	up.Catalog = ncl
+	up.New = DiffChapters(cl.Chapters, ncl.Chapters)
+
+	before := len(lib.store.Chapters(ncl))
+
+	lib.fetchContent(&ncl)
+
+	up.Missing = lib.MissingChapters(ncl)
+	if len(up.Missing) > 0 {
+		logrus.Warnf("《%s》缺少 %d 章", ncl.Name, len(up.Missing))
+	}
+
+	_, err = os.Stat(lib.store.BookFile(ncl, ".txt"))
+
+	if len(lib.store.Chapters(ncl)) != before || os.IsNotExist(err) {
+		if err = fileMerge(lib.store.BookDir(ncl), ncl.Name, nil); err != nil {
+			return up, err
+		}
+	}
+
+	if len(up.New) > 0 {
+		logrus.Infof("《%s》新增 %d 章，最新章节：%s", ncl.Name, len(up.New), ncl.LastChapter)
+	}
+
+	return up, nil
+}
+
+// NeedsUpdate 距上次检查是否超过更新间隔
+func (lib *Library) NeedsUpdate(cl Catalog) bool {
+	return time.Since(cl.CheckedAt) > lib.conf.Update.Interval
+}
+
+// UpdateAll 更新所有已下载的书籍
+func (lib *Library) UpdateAll() []BookUpdate {
+	cls, err := lib.db.List()
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+
+	ups := []BookUpdate{}
+	for _, cl := range cls {
+		if _, err := os.Stat(lib.store.BookFile(cl, ".txt")); err != nil {
+			continue
+		}
+
+		up, err := lib.UpdateBook(cl)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+
+		if len(up.New) > 0 {
+			ups = append(ups, up)
+		}
+	}
+
+	return ups
+}
@@ -0,0 +1,132 @@
+// 简繁转换
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//go:embed dict/s2t.txt
+var s2tDict string
+
+// Converter 基于词典的简繁转换，词组按最长匹配优先，其余逐字转换；nil 表示不转换
+type Converter struct {
+	suffix string
+	lang   string
+	dict   map[string]string
+	maxLen int // 词典中最长词条的字数
+}
+
+var (
+	s2t, t2s   *Converter
+	zhDictOnce sync.Once
+)
+
+func loadZhDict() {
+	s2t = &Converter{suffix: ".zh-Hant", lang: "zh-Hant", dict: make(map[string]string)}
+	t2s = &Converter{suffix: ".zh-Hans", lang: "zh-Hans", dict: make(map[string]string)}
+
+	sc := bufio.NewScanner(strings.NewReader(s2tDict))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fs := strings.Fields(line)
+		if len(fs) != 2 {
+			continue
+		}
+
+		s2t.add(fs[0], fs[1])
+		t2s.add(fs[1], fs[0])
+	}
+}
+
+func (c *Converter) add(from, to string) {
+	if _, ok := c.dict[from]; ok {
+		return
+	}
+
+	c.dict[from] = to
+	if n := utf8.RuneCountInString(from); n > c.maxLen {
+		c.maxLen = n
+	}
+}
+
+// S2T 简体转繁体
+func S2T() *Converter {
+	zhDictOnce.Do(loadZhDict)
+	return s2t
+}
+
+// T2S 繁体转简体
+func T2S() *Converter {
+	zhDictOnce.Do(loadZhDict)
+	return t2s
+}
+
+// ConverterByLang 按语言标记选择转换，简体返回 nil
+func ConverterByLang(lang string) (*Converter, error) {
+	switch strings.ToLower(lang) {
+	case "", "zh-cn", "zh-hans":
+		return nil, nil
+	case "zh-tw", "zh-hant":
+		return S2T(), nil
+	}
+	return nil, fmt.Errorf("unknown lang %s", lang)
+}
+
+// Suffix 导出文件名后缀，如 <书名>.zh-Hant.txt
+func (c *Converter) Suffix() string {
+	if c == nil {
+		return ""
+	}
+	return c.suffix
+}
+
+// Lang 导出文件的语言标记
+func (c *Converter) Lang() string {
+	if c == nil {
+		return "zh-CN"
+	}
+	return c.lang
+}
+
+// Convert 转换文本
+func (c *Converter) Convert(s string) string {
+	if c == nil || s == "" {
+		return s
+	}
+
+	rs := []rune(s)
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(rs); {
+		n := c.maxLen
+		if n > len(rs)-i {
+			n = len(rs) - i
+		}
+
+		for ; n > 0; n-- {
+			if to, ok := c.dict[string(rs[i:i+n])]; ok {
+				b.WriteString(to)
+				break
+			}
+		}
+
+		if n == 0 {
+			b.WriteRune(rs[i])
+			n = 1
+		}
+
+		i += n
+	}
+
+	return b.String()
+}